@@ -0,0 +1,186 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+/*
+Command restgen generates typed clients for a rest.Routable service. Clients
+can be generated in Go (-lang=go) or in TypeScript (-lang=ts).
+
+Since the routes of a service are only known at runtime, restgen builds and
+runs a small program which imports the package of the service, registers a new
+instance of the service type in a rest.Mux and feeds the resulting routes to
+the restgen package. It's meant to be invoked via go generate from within the
+package of the service:
+
+	//go:generate go run github.com/datacratic/gorest/cmd/restgen -type=PingService
+
+The service type must be exported, its pointer must implement rest.Routable and
+its zero value must be able to produce its routes. Packages named main can't be
+imported and are therefore not supported.
+*/
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+var program = template.Must(template.New("program").Parse(`package main
+
+import (
+	target {{ printf "%q" .ImportPath }}
+
+	"github.com/datacratic/gorest/rest"
+	"github.com/datacratic/gorest/rest/restgen"
+
+	"log"
+	"os"
+)
+
+func main() {
+	mux := &rest.Mux{DocPath: "-"}
+	mux.AddService(new(target.{{ .Type }}))
+
+	gen := &restgen.Generator{
+		Name:    {{ printf "%q" .Name }},
+		Package: {{ printf "%q" .Package }},
+		PkgPath: {{ printf "%q" .PkgPath }},
+		Routes:  mux.Routes(),
+	}
+
+	if err := gen.{{ .Lang }}(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+`))
+
+var langs = map[string]string{
+	"go": "Go",
+	"ts": "TypeScript",
+}
+
+var extensions = map[string]string{
+	"go": ".go",
+	"ts": ".ts",
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("restgen: ")
+
+	typeName := flag.String("type", "", "name of the rest.Routable type; required")
+	pkg := flag.String("pkg", ".", "package containing the type")
+	lang := flag.String("lang", "go", "language of the generated client: go or ts")
+	output := flag.String("o", "", "output file; defaults to <type>_client.<ext>")
+	name := flag.String("name", "", "name of the generated client; defaults to the type name")
+	outPkg := flag.String("outpkg", "", "import path of the package of the output file; defaults to the package of the type")
+	flag.Parse()
+
+	if len(*typeName) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if _, ok := langs[*lang]; !ok {
+		log.Fatalf("unsupported language: %s", *lang)
+	}
+
+	if len(*name) == 0 {
+		*name = *typeName
+	}
+
+	if len(*output) == 0 {
+		*output = strings.ToLower(*typeName) + "_client" + extensions[*lang]
+	}
+
+	importPath, pkgName := list(*pkg)
+
+	params := struct {
+		ImportPath string
+		Type       string
+		Name       string
+		Package    string
+		PkgPath    string
+		Lang       string
+	}{
+		ImportPath: importPath,
+		Type:       *typeName,
+		Name:       *name,
+		Package:    pkgName,
+		PkgPath:    importPath,
+		Lang:       langs[*lang],
+	}
+
+	if len(*outPkg) > 0 {
+		params.PkgPath = *outPkg
+		params.Package = filepath.Base(*outPkg)
+	}
+
+	src, err := run(params)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(*output, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// list returns the import path and the name of the given package.
+func list(pkg string) (string, string) {
+	out, err := exec.Command("go", "list", "-f", "{{.ImportPath}} {{.Name}}", pkg).Output()
+	if err != nil {
+		log.Fatalf("unable to list package '%s': %s", pkg, err)
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		log.Fatalf("unexpected output for package '%s': %s", pkg, out)
+	}
+
+	if fields[1] == "main" {
+		log.Fatalf("unable to import package main '%s'", fields[0])
+	}
+
+	return fields[0], fields[1]
+}
+
+// run builds and runs the generator program and returns its output. The
+// program is written in a directory of the current package so that it has
+// access to the same module and internal packages. The leading underscore
+// prevents the go tool from picking up the directory in package patterns.
+func run(params interface{}) ([]byte, error) {
+	dir, err := ioutil.TempDir(".", "_restgen")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "main.go")
+
+	var src bytes.Buffer
+	if err := program.Execute(&src, params); err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(file, src.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("go", "run", "./"+file)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("generator failed: %s\n%s", err, stderr.String())
+	}
+
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Batch controls how a group of requests is sent by Client.SendBatch.
+type Batch struct {
+
+	// FailFast cancels the remaining requests as soon as one request fails.
+	FailFast bool
+
+	// Quorum, if set, is the number of successful requests after which the
+	// remaining requests are canceled.
+	Quorum int
+
+	// Timeout is the overall deadline of the batch. If not set then only the
+	// deadline of the context applies.
+	Timeout time.Duration
+}
+
+// succeeded indicates whether the response counts as a success in a batch.
+func succeeded(resp *Response) bool {
+	return resp.Error == nil && resp.Code < http.StatusBadRequest
+}
+
+// SendAsync sends the request in the background and returns a channel which
+// will receive the response once the request completes.
+func (req *Request) SendAsync(ctx context.Context) <-chan *Response {
+	result := make(chan *Response, 1)
+	go func() { result <- req.SendContext(ctx) }()
+	return result
+}
+
+// SendAll concurrently sends all the given requests and waits for all of them
+// to complete. The responses are returned in the same order as the requests.
+// The requests must be created by the client and are subject to its Limit.
+// No requests are sent if one of them was created by another client in which
+// case all the responses contain a BatchError.
+func (client *Client) SendAll(reqs ...*Request) []*Response {
+	responses, err := client.SendBatch(context.Background(), Batch{}, reqs...)
+	if responses == nil && err != nil {
+		responses = make([]*Response, len(reqs))
+		for i, req := range reqs {
+			responses[i] = &Response{Request: req, Error: err}
+		}
+	}
+	return responses
+}
+
+// SendBatch concurrently sends all the given requests according to the given
+// batch options and returns the responses in the same order as the requests.
+// Requests canceled by the batch will contain a CanceledError. An error is
+// returned if a request failed while FailFast is set or if the Quorum could
+// not be reached. No requests are sent if the Quorum exceeds the number of
+// requests or if one of the requests wasn't created by the client.
+func (client *Client) SendBatch(ctx context.Context, batch Batch, reqs ...*Request) ([]*Response, *Error) {
+	for i, req := range reqs {
+		if req.REST != client {
+			return nil, ErrorFmt(BatchError, "request %d wasn't created by the client", i)
+		}
+	}
+
+	if batch.Quorum > len(reqs) {
+		return nil, ErrorFmt(BatchError, "quorum unreachable: quorum of %d out of %d", batch.Quorum, len(reqs))
+	}
+
+	var cancel context.CancelFunc
+	if batch.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, batch.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	type result struct {
+		index int
+		resp  *Response
+	}
+
+	results := make(chan result, len(reqs))
+	for i, req := range reqs {
+		go func(i int, req *Request) {
+			results <- result{i, req.SendContext(ctx)}
+		}(i, req)
+	}
+
+	responses := make([]*Response, len(reqs))
+	successes, failures := 0, 0
+	done := false
+
+	var err *Error
+
+	for n := 0; n < len(reqs); n++ {
+		result := <-results
+		responses[result.index] = result.resp
+
+		if done {
+			continue
+		}
+
+		if succeeded(result.resp) {
+			successes++
+
+			if batch.Quorum > 0 && successes >= batch.Quorum {
+				done = true
+				cancel()
+			}
+			continue
+		}
+
+		failures++
+
+		if batch.FailFast {
+			err = ErrorFmt(BatchError, "request %d failed: %s", result.index, describe(result.resp))
+			done = true
+			cancel()
+
+		} else if batch.Quorum > 0 && len(reqs)-failures < batch.Quorum {
+			err = ErrorFmt(BatchError, "quorum unreachable: %d failures for a quorum of %d out of %d",
+				failures, batch.Quorum, len(reqs))
+			done = true
+			cancel()
+		}
+	}
+
+	return responses, err
+}
+
+// describe returns a short description of the failure of a response.
+func describe(resp *Response) string {
+	if resp.Error != nil {
+		return resp.Error.Error()
+	}
+	return fmt.Sprintf("unexpected status code %d", resp.Code)
+}
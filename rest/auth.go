@@ -0,0 +1,352 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Principal is the identity of the caller of a route as established by the
+// Authenticator of a Mux. Handlers can receive the principal by declaring a
+// *Principal as their first argument.
+type Principal struct {
+
+	// Subject identifies the caller.
+	Subject string
+
+	// Scopes is the list of scopes granted to the caller.
+	Scopes []string
+
+	// Roles is the list of roles of the caller.
+	Roles []string
+
+	// Claims holds the raw claims of the credentials, if any.
+	Claims map[string]interface{}
+}
+
+var principalType = reflect.TypeOf((*Principal)(nil))
+
+// HasScope indicates whether the principal was granted the given scope.
+func (principal *Principal) HasScope(scope string) bool {
+	return principal != nil && containsString(principal.Scopes, scope)
+}
+
+// HasRole indicates whether the principal has the given role.
+func (principal *Principal) HasRole(role string) bool {
+	return principal != nil && containsString(principal.Roles, role)
+}
+
+func containsString(list []string, str string) bool {
+	for _, other := range list {
+		if other == str {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks that the principal satisfies the requirements of the
+// route: all its scopes and at least one of its roles.
+func (route *Route) authorize(principal *Principal) error {
+	for _, scope := range route.Scopes {
+		if !principal.HasScope(scope) {
+			return fmt.Errorf("missing scope '%s'", scope)
+		}
+	}
+
+	if len(route.Roles) == 0 {
+		return nil
+	}
+
+	for _, role := range route.Roles {
+		if principal.HasRole(role) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("missing one of the roles '%s'", strings.Join(route.Roles, "', '"))
+}
+
+// Authenticator establishes the identity of the callers of the routes of a
+// Mux. Authenticate returns a nil principal and a nil error if the request
+// doesn't carry credentials handled by the authenticator and returns an error
+// if the credentials are invalid. The body is the raw body of the request or
+// nil for multipart requests.
+type Authenticator interface {
+	Authenticate(httpReq *http.Request, body []byte) (*Principal, error)
+}
+
+// Authenticators is an Authenticator which returns the result of the first
+// authenticator which handles the credentials of a request.
+type Authenticators []Authenticator
+
+// Authenticate returns the principal of the first authenticator which handles
+// the credentials of the request.
+func (auths Authenticators) Authenticate(httpReq *http.Request, body []byte) (*Principal, error) {
+	for _, auth := range auths {
+		if principal, err := auth.Authenticate(httpReq, body); principal != nil || err != nil {
+			return principal, err
+		}
+	}
+	return nil, nil
+}
+
+// bearerToken returns the token of an Authorization header using the bearer
+// scheme.
+func bearerToken(httpReq *http.Request) (string, bool) {
+	const prefix = "bearer "
+
+	header := httpReq.Header.Get("Authorization")
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
+
+// BearerAuthenticator is an Authenticator which verifies opaque bearer tokens
+// with the given function.
+type BearerAuthenticator func(token string) (*Principal, error)
+
+// Authenticate verifies the bearer token of the request, if any.
+func (auth BearerAuthenticator) Authenticate(httpReq *http.Request, body []byte) (*Principal, error) {
+	token, ok := bearerToken(httpReq)
+	if !ok {
+		return nil, nil
+	}
+	return auth(token)
+}
+
+// BasicAuthenticator is an Authenticator which verifies the credentials of the
+// HTTP basic authentication scheme with the given function.
+type BasicAuthenticator func(username, password string) (*Principal, error)
+
+// Authenticate verifies the basic credentials of the request, if any.
+func (auth BasicAuthenticator) Authenticate(httpReq *http.Request, body []byte) (*Principal, error) {
+	username, password, ok := httpReq.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	return auth(username, password)
+}
+
+// JWTAuthenticator is an Authenticator which verifies bearer tokens formatted
+// as JSON Web Tokens signed with HMAC-SHA256. The subject of the principal is
+// read from the "sub" claim, the scopes from the space separated "scope" claim
+// or from the "scp" list claim and the roles from the "roles" list claim.
+type JWTAuthenticator struct {
+
+	// Secret is the key used to sign the tokens.
+	Secret []byte
+
+	// Issuer, if set, must match the "iss" claim of the tokens.
+	Issuer string
+
+	// Audience, if set, must be part of the "aud" claim of the tokens.
+	Audience string
+
+	// Leeway is the tolerated clock skew when checking the "exp" and "nbf"
+	// claims of the tokens.
+	Leeway time.Duration
+}
+
+// Authenticate verifies the JWT bearer token of the request, if any.
+func (auth *JWTAuthenticator) Authenticate(httpReq *http.Request, body []byte) (*Principal, error) {
+	token, ok := bearerToken(httpReq)
+	if !ok {
+		return nil, nil
+	}
+	return auth.Verify(token)
+}
+
+// Verify checks the signature and the claims of the given token and returns
+// its principal.
+func (auth *JWTAuthenticator) Verify(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("unsupported token algorithm: '%s'", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	if !hmac.Equal(signature, signJWT(auth.Secret, parts[0]+"."+parts[1])) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(auth.Leeway)) {
+		return nil, errors.New("token expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(auth.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+
+	if len(auth.Issuer) > 0 && claims["iss"] != auth.Issuer {
+		return nil, fmt.Errorf("invalid token issuer: '%v'", claims["iss"])
+	}
+
+	if len(auth.Audience) > 0 && !containsString(stringsClaim(claims["aud"]), auth.Audience) {
+		return nil, fmt.Errorf("invalid token audience: '%v'", claims["aud"])
+	}
+
+	principal := &Principal{Claims: claims, Roles: stringsClaim(claims["roles"])}
+	principal.Subject, _ = claims["sub"].(string)
+
+	if scope, ok := claims["scope"].(string); ok {
+		principal.Scopes = strings.Fields(scope)
+	} else {
+		principal.Scopes = stringsClaim(claims["scp"])
+	}
+
+	return principal, nil
+}
+
+// NewJWT returns a JSON Web Token containing the given claims and signed with
+// HMAC-SHA256 using the given secret.
+func NewJWT(secret []byte, claims map[string]interface{}) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) +
+		"." + base64.RawURLEncoding.EncodeToString(payload)
+
+	return token + "." + base64.RawURLEncoding.EncodeToString(signJWT(secret, token)), nil
+}
+
+func signJWT(secret []byte, data string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func decodeJWTPart(part string, obj interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+
+	if err := json.Unmarshal(data, obj); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// stringsClaim converts a claim which is either a string or a list of strings
+// into a list of strings.
+func stringsClaim(claim interface{}) []string {
+	switch value := claim.(type) {
+
+	case string:
+		return []string{value}
+
+	case []interface{}:
+		var result []string
+		for _, item := range value {
+			if str, ok := item.(string); ok {
+				result = append(result, str)
+			}
+		}
+		return result
+	}
+
+	return nil
+}
+
+// DefaultMaxSkew is the default maximum difference between the timestamp of a
+// signed request and the time at which it's received.
+const DefaultMaxSkew = 5 * time.Minute
+
+// HMACAuthenticator is an Authenticator which verifies the signature of the
+// requests signed by HMACSigner. The subject of the principal is the key ID
+// used to sign the request. Signed multipart requests are rejected since their
+// body isn't available to verify the signature.
+type HMACAuthenticator struct {
+
+	// Keys holds the shared secrets indexed by key ID.
+	Keys map[string][]byte
+
+	// MaxSkew is the maximum difference between the timestamp of a request
+	// and the time at which it's received. Defaults to DefaultMaxSkew.
+	MaxSkew time.Duration
+}
+
+// Authenticate verifies the signature of the request, if any.
+func (auth *HMACAuthenticator) Authenticate(httpReq *http.Request, body []byte) (*Principal, error) {
+	const prefix = HMACScheme + " "
+
+	header := httpReq.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return nil, nil
+	}
+
+	i := strings.LastIndexByte(header, ':')
+	if i < len(prefix) {
+		return nil, errors.New("malformed signature")
+	}
+
+	keyID, signature := header[len(prefix):i], header[i+1:]
+
+	if body == nil {
+		return nil, errors.New("signed multipart requests are not supported")
+	}
+
+	secret, ok := auth.Keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key '%s'", keyID)
+	}
+
+	timestamp := httpReq.Header.Get(TimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.New("malformed signature timestamp")
+	}
+
+	maxSkew := auth.MaxSkew
+	if maxSkew == 0 {
+		maxSkew = DefaultMaxSkew
+	}
+
+	if skew := time.Since(time.Unix(seconds, 0)); skew > maxSkew || skew < -maxSkew {
+		return nil, errors.New("signature timestamp out of range")
+	}
+
+	expected := Signature(secret, httpReq.Method, httpReq.URL.RequestURI(), timestamp, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, errors.New("invalid signature")
+	}
+
+	return &Principal{Subject: keyID}, nil
+}
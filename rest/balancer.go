@@ -0,0 +1,203 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultEjectDuration is the default duration for which an unhealthy
+// endpoint is removed from the set of endpoints available to a Client.
+const DefaultEjectDuration = 10 * time.Second
+
+// Endpoint tracks the state of one of the remote hosts a Client sends its
+// requests to.
+type Endpoint struct {
+
+	// Addr is the address of the remote host.
+	Addr string
+
+	outstanding int64
+	failures    int64
+	ejected     int64
+}
+
+// Outstanding returns the number of requests currently being sent to the
+// endpoint.
+func (endpoint *Endpoint) Outstanding() int {
+	return int(atomic.LoadInt64(&endpoint.outstanding))
+}
+
+// Healthy returns false if the endpoint was ejected because of consecutive
+// send failures and the ejection period hasn't elapsed yet.
+func (endpoint *Endpoint) Healthy() bool {
+	return time.Now().UnixNano() >= atomic.LoadInt64(&endpoint.ejected)
+}
+
+func (endpoint *Endpoint) begin() {
+	atomic.AddInt64(&endpoint.outstanding, 1)
+}
+
+func (endpoint *Endpoint) end() {
+	atomic.AddInt64(&endpoint.outstanding, -1)
+}
+
+// record updates the health of the endpoint from the result of a request.
+// Endpoints are ejected for the given duration once maxFailures consecutive
+// requests failed to be sent.
+func (endpoint *Endpoint) record(resp *Response, maxFailures int, eject time.Duration) {
+	if maxFailures <= 0 {
+		return
+	}
+
+	if resp.Error == nil || resp.Error.Type != SendRequestError {
+		atomic.StoreInt64(&endpoint.failures, 0)
+		return
+	}
+
+	if atomic.AddInt64(&endpoint.failures, 1) < int64(maxFailures) {
+		return
+	}
+
+	if eject == 0 {
+		eject = DefaultEjectDuration
+	}
+
+	atomic.StoreInt64(&endpoint.failures, 0)
+	atomic.StoreInt64(&endpoint.ejected, time.Now().Add(eject).UnixNano())
+}
+
+// Balancer selects the endpoint to which a request is sent.
+type Balancer interface {
+
+	// Select returns one of the given endpoints for the request. The list of
+	// endpoints is never empty.
+	Select(req *Request, endpoints []*Endpoint) *Endpoint
+}
+
+// RoundRobin is a Balancer which cycles through the endpoints.
+type RoundRobin struct {
+	next uint64
+}
+
+// Select returns the next endpoint in the list.
+func (balancer *RoundRobin) Select(req *Request, endpoints []*Endpoint) *Endpoint {
+	i := atomic.AddUint64(&balancer.next, 1) - 1
+	return endpoints[i%uint64(len(endpoints))]
+}
+
+// LeastOutstanding is a Balancer which selects the endpoint with the fewest
+// requests in flight.
+type LeastOutstanding struct{}
+
+// Select returns the endpoint with the fewest outstanding requests.
+func (LeastOutstanding) Select(req *Request, endpoints []*Endpoint) *Endpoint {
+	best := endpoints[0]
+	for _, endpoint := range endpoints[1:] {
+		if endpoint.Outstanding() < best.Outstanding() {
+			best = endpoint
+		}
+	}
+	return best
+}
+
+// PowerOfTwo is a Balancer which picks two endpoints at random and selects
+// the one with the fewest requests in flight.
+type PowerOfTwo struct{}
+
+// Select returns the least loaded of two randomly picked endpoints.
+func (PowerOfTwo) Select(req *Request, endpoints []*Endpoint) *Endpoint {
+	if len(endpoints) == 1 {
+		return endpoints[0]
+	}
+
+	i := rand.Intn(len(endpoints))
+	j := rand.Intn(len(endpoints) - 1)
+	if j >= i {
+		j++
+	}
+
+	if endpoints[j].Outstanding() < endpoints[i].Outstanding() {
+		return endpoints[j]
+	}
+	return endpoints[i]
+}
+
+// ConsistentHash is a Balancer which maps the Key of a request to an endpoint
+// using a consistent hashing ring such that changes to the set of endpoints
+// only remap a small portion of the keys. Requests without a key are sent to
+// a random endpoint.
+type ConsistentHash struct {
+
+	// Replicas is the number of points on the ring for each endpoint.
+	// Defaults to 100.
+	Replicas int
+
+	mutex sync.Mutex
+	addrs string
+	ring  []uint32
+	nodes map[uint32]*Endpoint
+}
+
+// Select returns the endpoint that owns the key of the request on the ring.
+func (balancer *ConsistentHash) Select(req *Request, endpoints []*Endpoint) *Endpoint {
+	if len(req.Key) == 0 {
+		return endpoints[rand.Intn(len(endpoints))]
+	}
+
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+
+	balancer.build(endpoints)
+
+	hash := crc32.ChecksumIEEE([]byte(req.Key))
+	i := sort.Search(len(balancer.ring), func(i int) bool { return balancer.ring[i] >= hash })
+	if i == len(balancer.ring) {
+		i = 0
+	}
+
+	return balancer.nodes[balancer.ring[i]]
+}
+
+// build regenerates the ring if the set of endpoints changed.
+func (balancer *ConsistentHash) build(endpoints []*Endpoint) {
+	var addrs []string
+	for _, endpoint := range endpoints {
+		addrs = append(addrs, endpoint.Addr)
+	}
+
+	key := strings.Join(addrs, "\n")
+	if key == balancer.addrs && balancer.nodes != nil {
+		return
+	}
+
+	replicas := balancer.Replicas
+	if replicas <= 0 {
+		replicas = 100
+	}
+
+	balancer.addrs = key
+	balancer.ring = make([]uint32, 0, len(endpoints)*replicas)
+	balancer.nodes = make(map[uint32]*Endpoint)
+
+	for _, endpoint := range endpoints {
+		for i := 0; i < replicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(endpoint.Addr + "#" + strconv.Itoa(i)))
+			if _, ok := balancer.nodes[hash]; ok {
+				continue
+			}
+
+			balancer.nodes[hash] = endpoint
+			balancer.ring = append(balancer.ring, hash)
+		}
+	}
+
+	sort.Slice(balancer.ring, func(i, j int) bool { return balancer.ring[i] < balancer.ring[j] })
+}
@@ -0,0 +1,285 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ProgressFunc is called as the body of a request is being sent with the
+// number of bytes sent so far and the total number of bytes of the body or -1
+// if the total is unknown. The count restarts from zero for every attempt.
+type ProgressFunc func(sent, total int64)
+
+// bodyFunc returns the reader for the body of an attempt of a request. The
+// reader is closed once the attempt is done with it.
+type bodyFunc func() (io.Reader, error)
+
+// replay returns a bodyFunc for the given reader and whether the reader can
+// be read more than once. Readers implementing io.Seeker are rewound to their
+// initial offset for every attempt while other readers can only be read once.
+// The given reader is never closed since it's owned by the caller.
+func replay(reader io.Reader) (bodyFunc, bool) {
+	if seeker, ok := reader.(io.Seeker); ok {
+		if offset, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			return func() (io.Reader, error) {
+				_, err := seeker.Seek(offset, io.SeekStart)
+				return ioutil.NopCloser(reader), err
+			}, true
+		}
+	}
+
+	var mutex sync.Mutex
+	used := false
+
+	return func() (io.Reader, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if used {
+			return nil, errors.New("body reader can't be read more than once")
+		}
+
+		used = true
+		return ioutil.NopCloser(reader), nil
+	}, false
+}
+
+// readerLength returns the number of bytes left to read from the reader or -1
+// if it can't be determined.
+func readerLength(reader io.Reader) int64 {
+	if lener, ok := reader.(interface{ Len() int }); ok {
+		return int64(lener.Len())
+	}
+
+	if seeker, ok := reader.(io.Seeker); ok {
+		offset, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if _, err2 := seeker.Seek(offset, io.SeekStart); err != nil || err2 != nil {
+			return -1
+		}
+
+		return end - offset
+	}
+
+	return -1
+}
+
+type progressReader struct {
+	io.Reader
+	progress ProgressFunc
+	sent     int64
+	total    int64
+}
+
+func (reader *progressReader) Read(buf []byte) (int, error) {
+	n, err := reader.Reader.Read(buf)
+	if n > 0 {
+		reader.sent += int64(n)
+		reader.progress(reader.sent, reader.total)
+	}
+	return n, err
+}
+
+// Close closes the wrapped reader such that the goroutines streaming the body
+// stop when the body isn't consumed.
+func (reader *progressReader) Close() error {
+	return closeReader(reader.Reader)
+}
+
+// closeReader closes the given reader if it's an io.Closer.
+func closeReader(reader io.Reader) error {
+	if closer, ok := reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// gzipPipe is the reader end of the pipe used to compress a body.
+type gzipPipe struct {
+	*io.PipeReader
+	source io.Reader
+}
+
+// Close closes the pipe, which stops the compression, and the compressed
+// reader.
+func (pipe *gzipPipe) Close() error {
+	pipe.CloseWithError(errors.New("body closed"))
+	return closeReader(pipe.source)
+}
+
+// gzipReader compresses the given reader on the fly.
+func gzipReader(reader io.Reader, level int) io.Reader {
+	pr, pw := io.Pipe()
+
+	go func() {
+		gz, err := gzip.NewWriterLevel(pw, level)
+		if err == nil {
+			if _, err = io.Copy(gz, reader); err == nil {
+				err = gz.Close()
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return &gzipPipe{pr, reader}
+}
+
+// Multipart builds a multipart/form-data request body whose parts are streamed
+// when the request is sent. Parts created from file paths are re-opened for
+// every attempt of the request.
+type Multipart struct {
+	parts    []multipartPart
+	boundary string
+	err      *Error
+}
+
+type multipartPart struct {
+	header textproto.MIMEHeader
+	open   func() (io.ReadCloser, error)
+	replay bool
+}
+
+// NewMultipart creates a new empty multipart body.
+func NewMultipart() *Multipart {
+	return &Multipart{boundary: multipart.NewWriter(nil).Boundary()}
+}
+
+// ContentType returns the value of the Content-Type header of the body.
+func (body *Multipart) ContentType() string {
+	return "multipart/form-data; boundary=" + body.boundary
+}
+
+func (body *Multipart) add(header textproto.MIMEHeader, open func() (io.ReadCloser, error), replay bool) *Multipart {
+	body.parts = append(body.parts, multipartPart{header, open, replay})
+	return body
+}
+
+func partHeader(name, filename, contentType string) textproto.MIMEHeader {
+	header := make(textproto.MIMEHeader)
+
+	disposition := `form-data; name="` + escapeQuotes(name) + `"`
+	if len(filename) > 0 {
+		disposition += `; filename="` + escapeQuotes(filename) + `"`
+	}
+
+	header.Set("Content-Disposition", disposition)
+	if len(contentType) > 0 {
+		header.Set("Content-Type", contentType)
+	}
+
+	return header
+}
+
+func escapeQuotes(value string) string {
+	var buffer bytes.Buffer
+	for _, c := range value {
+		if c == '"' || c == '\\' {
+			buffer.WriteByte('\\')
+		}
+		buffer.WriteRune(c)
+	}
+	return buffer.String()
+}
+
+// AddField adds a plain text field.
+func (body *Multipart) AddField(name, value string) *Multipart {
+	return body.add(partHeader(name, "", ""), func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader([]byte(value))), nil
+	}, true)
+}
+
+// AddJSON adds a part containing the JSON serialization of the given object.
+func (body *Multipart) AddJSON(name string, obj interface{}) *Multipart {
+	js, err := json.Marshal(obj)
+	if err != nil {
+		body.err = &Error{MarshalError, err}
+		return body
+	}
+
+	return body.add(partHeader(name, "", "application/json"), func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(js)), nil
+	}, true)
+}
+
+// AddFile adds a file part whose content is read from the given reader. See
+// Request.SetBodyReader for details on how readers are replayed.
+func (body *Multipart) AddFile(name, filename string, reader io.Reader) *Multipart {
+	open, ok := replay(reader)
+
+	return body.add(partHeader(name, filename, "application/octet-stream"), func() (io.ReadCloser, error) {
+		reader, err := open()
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(reader), nil
+	}, ok)
+}
+
+// AddFilePath adds a file part whose content is read from the file at the
+// given path.
+func (body *Multipart) AddFilePath(name, path string) *Multipart {
+	return body.add(partHeader(name, filepath.Base(path), "application/octet-stream"), func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}, true)
+}
+
+func (body *Multipart) replayable() bool {
+	for _, part := range body.parts {
+		if !part.replay {
+			return false
+		}
+	}
+	return true
+}
+
+// open returns a reader which streams the encoded parts.
+func (body *Multipart) open() (io.Reader, error) {
+	pr, pw := io.Pipe()
+
+	go func() {
+		writer := multipart.NewWriter(pw)
+		writer.SetBoundary(body.boundary)
+
+		pw.CloseWithError(body.write(writer))
+	}()
+
+	return pr, nil
+}
+
+func (body *Multipart) write(writer *multipart.Writer) error {
+	for _, part := range body.parts {
+		dst, err := writer.CreatePart(part.header)
+		if err != nil {
+			return err
+		}
+
+		src, err := part.open()
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(dst, src)
+		src.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return writer.Close()
+}
@@ -0,0 +1,400 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a circuit of a CircuitBreaker.
+type BreakerState int
+
+const (
+	// BreakerClosed indicates that requests flow normally.
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen indicates that requests fail fast with a CircuitOpen error.
+	BreakerOpen
+
+	// BreakerHalfOpen indicates that a limited number of probe requests are
+	// let through to determine whether the circuit should be closed.
+	BreakerHalfOpen
+)
+
+// String returns the string representation of the state.
+func (state BreakerState) String() string {
+	switch state {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+const breakerBuckets = 10
+
+// CircuitBreaker stops sending requests to a remote host once it degrades.
+// Each host, and optionally each route of each host, has its own circuit which
+// opens when the rate of failed requests over Window exceeds ErrorRate. While
+// open, requests fail immediately with a CircuitOpen error. After OpenDuration
+// the circuit becomes half-open and lets Probes requests through: the circuit
+// closes if they all succeed and opens again otherwise. Circuits which stayed
+// closed and unused for a Window are forgotten.
+type CircuitBreaker struct {
+
+	// Window is the duration over which the error rate is measured. Defaults
+	// to 10 seconds and can't be shorter than 10 nanoseconds.
+	Window time.Duration
+
+	// MinRequests is the minimum number of requests within Window before the
+	// circuit can open. Defaults to 20.
+	MinRequests int
+
+	// ErrorRate is the fraction, between 0 and 1, of failed requests within
+	// Window that opens the circuit. Defaults to 0.5.
+	ErrorRate float64
+
+	// Latency is the round-trip latency above which a request is counted as a
+	// failure. If not set then latency is ignored.
+	Latency time.Duration
+
+	// OpenDuration is the duration for which the circuit stays open before
+	// becoming half-open. Defaults to 5 seconds.
+	OpenDuration time.Duration
+
+	// Probes is the number of probe requests let through while the circuit is
+	// half-open. Defaults to 1.
+	Probes int
+
+	// PerRoute keys the circuits by host and route instead of only by host.
+	// Requests not created via Client.NewRouteRequest use the circuit of
+	// their host.
+	PerRoute bool
+
+	// IsFailure classifies the response of a request as a failure. Defaults
+	// to send errors, timeouts and 5xx status codes.
+	IsFailure func(*Response) bool
+
+	mutex    sync.Mutex
+	circuits map[string]*circuit
+	swept    time.Time
+}
+
+type bucket struct {
+	total    int
+	failures int
+}
+
+type circuit struct {
+	mutex sync.Mutex
+
+	state      BreakerState
+	generation int
+	opened     time.Time
+	probes     int
+	successes  int
+
+	buckets [breakerBuckets]bucket
+	head    int
+	start   time.Time
+	used    time.Time
+}
+
+// ticket is handed out to every request let through by a circuit and is used
+// to discard the results of requests that were started before the last state
+// change.
+type ticket struct {
+	circuit    *circuit
+	generation int
+}
+
+func (breaker *CircuitBreaker) window() time.Duration {
+	if breaker.Window >= breakerBuckets {
+		return breaker.Window
+	} else if breaker.Window > 0 {
+		return breakerBuckets
+	}
+	return 10 * time.Second
+}
+
+func (breaker *CircuitBreaker) minRequests() int {
+	if breaker.MinRequests > 0 {
+		return breaker.MinRequests
+	}
+	return 20
+}
+
+func (breaker *CircuitBreaker) errorRate() float64 {
+	if breaker.ErrorRate > 0 {
+		return breaker.ErrorRate
+	}
+	return 0.5
+}
+
+func (breaker *CircuitBreaker) openDuration() time.Duration {
+	if breaker.OpenDuration > 0 {
+		return breaker.OpenDuration
+	}
+	return 5 * time.Second
+}
+
+func (breaker *CircuitBreaker) probes() int {
+	if breaker.Probes > 0 {
+		return breaker.Probes
+	}
+	return 1
+}
+
+func (breaker *CircuitBreaker) isFailure(resp *Response) bool {
+	if breaker.IsFailure != nil {
+		return breaker.IsFailure(resp)
+	}
+
+	if resp.Error != nil {
+		return resp.Error.Type == SendRequestError || resp.Error.Type == TimeoutError
+	}
+
+	return resp.Code >= http.StatusInternalServerError
+}
+
+// key returns the key of the circuit used for the request sent to the given
+// host. Requests without a route share the circuit of their host to avoid
+// creating a circuit for every distinct path.
+func (breaker *CircuitBreaker) key(req *Request, host string) string {
+	if !breaker.PerRoute || req.Route == nil {
+		return host
+	}
+	return host + " " + req.Method + " " + req.Route.Path.String()
+}
+
+// circuit returns the circuit with the given key, creating it if necessary.
+func (breaker *CircuitBreaker) circuit(key string) *circuit {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	now := time.Now()
+	breaker.sweep(now)
+
+	if breaker.circuits == nil {
+		breaker.circuits = make(map[string]*circuit)
+	}
+
+	c, ok := breaker.circuits[key]
+	if !ok {
+		c = &circuit{start: now, used: now}
+		breaker.circuits[key] = c
+	}
+
+	return c
+}
+
+// lookup returns the circuit with the given key or nil if it doesn't exist.
+func (breaker *CircuitBreaker) lookup(key string) *circuit {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	return breaker.circuits[key]
+}
+
+// sweep forgets, at most once per window, the circuits which are closed and
+// weren't used for a window. A request still in flight on a forgotten circuit
+// is recorded against it and doesn't affect the circuit that replaces it.
+func (breaker *CircuitBreaker) sweep(now time.Time) {
+	window := breaker.window()
+	if now.Sub(breaker.swept) < window {
+		return
+	}
+	breaker.swept = now
+
+	for key, c := range breaker.circuits {
+		c.mutex.Lock()
+		if c.state == BreakerClosed && now.Sub(c.used) >= window {
+			delete(breaker.circuits, key)
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// State returns the state of the circuit with the given key. Keys are hosts or,
+// if PerRoute is set, a host followed by the method and path of a route.
+// Unknown keys are reported as closed.
+func (breaker *CircuitBreaker) State(key string) BreakerState {
+	c := breaker.lookup(key)
+	if c == nil {
+		return BreakerClosed
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	breaker.update(c, time.Now())
+	return c.state
+}
+
+// States returns the state of all the circuits known to the breaker indexed by
+// their key.
+func (breaker *CircuitBreaker) States() map[string]BreakerState {
+	breaker.mutex.Lock()
+	keys := make([]string, 0, len(breaker.circuits))
+	for key := range breaker.circuits {
+		keys = append(keys, key)
+	}
+	breaker.mutex.Unlock()
+
+	states := make(map[string]BreakerState)
+	for _, key := range keys {
+		states[key] = breaker.State(key)
+	}
+	return states
+}
+
+// available returns false if a request with the given key would currently be
+// rejected.
+func (breaker *CircuitBreaker) available(key string) bool {
+	c := breaker.lookup(key)
+	if c == nil {
+		return true
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	breaker.update(c, time.Now())
+
+	switch c.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		return c.probes < breaker.probes()
+	}
+	return true
+}
+
+// allow returns a ticket if the request with the given key can be sent.
+func (breaker *CircuitBreaker) allow(key string) (*ticket, bool) {
+	c := breaker.circuit(key)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	breaker.update(c, now)
+	c.used = now
+
+	switch c.state {
+	case BreakerOpen:
+		return nil, false
+
+	case BreakerHalfOpen:
+		if c.probes >= breaker.probes() {
+			return nil, false
+		}
+		c.probes++
+	}
+
+	return &ticket{c, c.generation}, true
+}
+
+// release returns a ticket whose request wasn't sent or whose outcome says
+// nothing about the health of the host such that another probe can be let
+// through while the circuit is half-open.
+func (breaker *CircuitBreaker) release(t *ticket) {
+	c := t.circuit
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if t.generation == c.generation && c.state == BreakerHalfOpen && c.probes > 0 {
+		c.probes--
+	}
+}
+
+// record updates the circuit of the ticket with the result of the request.
+// Requests which were canceled or whose deadline expired, including the
+// requests that lost a hedging race, are released instead of recorded.
+func (breaker *CircuitBreaker) record(t *ticket, resp *Response, latency time.Duration) {
+	if resp.Error != nil && (resp.Error.Type == CanceledError || resp.Error.Type == DeadlineError) {
+		breaker.release(t)
+		return
+	}
+
+	failure := breaker.isFailure(resp)
+	if breaker.Latency > 0 && latency > breaker.Latency {
+		failure = true
+	}
+
+	c := t.circuit
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	breaker.update(c, now)
+	c.used = now
+
+	if t.generation != c.generation {
+		return
+	}
+
+	switch c.state {
+
+	case BreakerHalfOpen:
+		if failure {
+			breaker.transition(c, BreakerOpen, now)
+		} else if c.successes++; c.successes >= breaker.probes() {
+			breaker.transition(c, BreakerClosed, now)
+		}
+
+	case BreakerClosed:
+		b := &c.buckets[c.head]
+		b.total++
+		if failure {
+			b.failures++
+		}
+
+		var total, failures int
+		for _, b := range c.buckets {
+			total += b.total
+			failures += b.failures
+		}
+
+		if total >= breaker.minRequests() && float64(failures)/float64(total) >= breaker.errorRate() {
+			breaker.transition(c, BreakerOpen, now)
+		}
+	}
+}
+
+// update rotates the buckets of the circuit and moves open circuits to the
+// half-open state once their open duration elapsed.
+func (breaker *CircuitBreaker) update(c *circuit, now time.Time) {
+	if c.state == BreakerOpen && now.Sub(c.opened) >= breaker.openDuration() {
+		breaker.transition(c, BreakerHalfOpen, now)
+	}
+
+	width := breaker.window() / breakerBuckets
+	n := int(now.Sub(c.start) / width)
+	if n <= 0 {
+		return
+	}
+
+	for i := 0; i < n && i < breakerBuckets; i++ {
+		c.head = (c.head + 1) % breakerBuckets
+		c.buckets[c.head] = bucket{}
+	}
+	c.start = c.start.Add(time.Duration(n) * width)
+}
+
+func (breaker *CircuitBreaker) transition(c *circuit, state BreakerState, now time.Time) {
+	c.state = state
+	c.generation++
+	c.probes = 0
+	c.successes = 0
+	c.buckets = [breakerBuckets]bucket{}
+
+	if state == BreakerOpen {
+		c.opened = now
+	}
+}
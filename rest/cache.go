@@ -0,0 +1,258 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheSize is the default maximum number of responses cached by a
+// route with a CacheTTL.
+const DefaultCacheSize = 1024
+
+// Tagged can be implemented by the values returned by route handlers to
+// provide their own entity tag. Otherwise the Mux derives the entity tag of
+// the responses of GET routes from a hash of their body.
+type Tagged interface {
+	ETag() string
+}
+
+// Timestamped can be implemented by the values returned by route handlers to
+// provide their modification time which is sent in the Last-Modified header
+// and used to answer If-Modified-Since requests.
+type Timestamped interface {
+	LastModified() time.Time
+}
+
+// output is the result of the invocation of a route's handler.
+type output struct {
+	body     []byte
+	etag     string
+	modified time.Time
+}
+
+// describe extracts the entity tag and modification time of the value
+// returned by a handler.
+func (out *output) describe(value interface{}) {
+	if tagged, ok := value.(Tagged); ok {
+		out.etag = quoteETag(tagged.ETag())
+	}
+
+	if timestamped, ok := value.(Timestamped); ok {
+		out.modified = timestamped.LastModified().UTC().Truncate(time.Second)
+	}
+}
+
+// hashETag returns a strong entity tag derived from the given body.
+func hashETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// quoteETag turns the given tag into a strong entity tag unless it's already
+// a quoted strong or weak entity tag.
+func quoteETag(tag string) string {
+	if len(tag) == 0 || strings.HasPrefix(tag, `"`) || strings.HasPrefix(tag, `W/"`) {
+		return tag
+	}
+	return `"` + tag + `"`
+}
+
+// encodeETag returns the entity tag of the given representation of an entity
+// such that its compressed and uncompressed representations don't share the
+// same strong entity tag.
+func encodeETag(etag, encoding string) string {
+	if len(etag) == 0 || len(encoding) == 0 {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// splitETags splits the given If-Match or If-None-Match header into its
+// entity tags. Commas within quoted entity tags don't separate the tags.
+func splitETags(header string) []string {
+	var tags []string
+
+	for {
+		header = strings.TrimLeft(header, " \t,")
+		if len(header) == 0 {
+			return tags
+		}
+
+		i := 0
+		if strings.HasPrefix(header, "W/") {
+			i = 2
+		}
+
+		if i < len(header) && header[i] == '"' {
+			if end := strings.IndexByte(header[i+1:], '"'); end >= 0 {
+				i += end + 2
+			} else {
+				i = len(header)
+			}
+		}
+
+		if end := strings.IndexByte(header[i:], ','); end >= 0 {
+			i += end
+		} else {
+			i = len(header)
+		}
+
+		tags = append(tags, strings.TrimSpace(header[:i]))
+		header = header[i:]
+	}
+}
+
+// matchETag indicates whether the given If-None-Match header matches the
+// entity tag using the weak comparison.
+func matchETag(header, etag string) bool {
+	if len(etag) == 0 {
+		return false
+	}
+
+	for _, tag := range splitETags(header) {
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notModified indicates whether the request is a conditional request which
+// can be answered with a 304 status code. If-Modified-Since is ignored when
+// If-None-Match is present.
+func notModified(httpReq *http.Request, etag string, modified time.Time) bool {
+	if header := httpReq.Header.Get("If-None-Match"); len(header) > 0 {
+		return matchETag(header, etag)
+	}
+
+	if header := httpReq.Header.Get("If-Modified-Since"); len(header) > 0 && !modified.IsZero() {
+		since, err := http.ParseTime(header)
+		return err == nil && !modified.After(since)
+	}
+
+	return false
+}
+
+type cacheEntry struct {
+	out     *output
+	expires time.Time
+}
+
+// responseCache holds the cached responses of a route.
+type responseCache struct {
+	mutex   sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func (cache *responseCache) get(key string, now time.Time) (*output, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if !now.Before(entry.expires) {
+		delete(cache.entries, key)
+		return nil, false
+	}
+
+	return entry.out, true
+}
+
+func (cache *responseCache) put(key string, out *output, expires time.Time, size int) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cache.entries == nil {
+		cache.entries = make(map[string]cacheEntry)
+	}
+
+	if _, ok := cache.entries[key]; !ok && len(cache.entries) >= size {
+		now := time.Now()
+		for other, entry := range cache.entries {
+			if !now.Before(entry.expires) {
+				delete(cache.entries, other)
+			}
+		}
+
+		for other := range cache.entries {
+			if len(cache.entries) < size {
+				break
+			}
+			delete(cache.entries, other)
+		}
+	}
+
+	cache.entries[key] = cacheEntry{out, expires}
+}
+
+func (cache *responseCache) purge() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.entries = nil
+}
+
+func (route *Route) cacheSize() int {
+	if route.CacheSize > 0 {
+		return route.CacheSize
+	}
+	return DefaultCacheSize
+}
+
+// cacheKey returns the key of the cached response for the given principal and
+// path arguments.
+func (route *Route) cacheKey(principal *Principal, args []string) string {
+	var key []string
+
+	if route.principal {
+		if principal == nil {
+			key = append(key, "-")
+		} else {
+			key = append(key, strconv.Quote(principal.Subject))
+		}
+	}
+
+	for _, arg := range args {
+		key = append(key, strconv.Quote(arg))
+	}
+
+	return strings.Join(key, " ")
+}
+
+// cached returns the cached response for the given principal and path
+// arguments if the route has a CacheTTL. Otherwise or if the response isn't
+// cached then the handler is invoked via invoke.
+func (route *Route) cached(principal *Principal, args []string, invoke func() (*output, *Error)) (*output, *Error) {
+	if route.CacheTTL <= 0 {
+		return invoke()
+	}
+
+	key := route.cacheKey(principal, args)
+	if out, ok := route.cache.get(key, time.Now()); ok {
+		return out, nil
+	}
+
+	out, err := invoke()
+	if err == nil {
+		route.cache.put(key, out, time.Now().Add(route.CacheTTL), route.cacheSize())
+	}
+
+	return out, err
+}
+
+// PurgeCache removes all the responses cached by the route. Typically called
+// by the handlers of the routes which modify the resources of the route.
+func (route *Route) PurgeCache() {
+	route.cache.purge()
+}
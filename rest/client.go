@@ -5,8 +5,8 @@ package rest
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -40,30 +40,187 @@ type Client struct {
 	GzipLevel int
 
 	// Limit sets a hard limit on the number of concurrent requests. If not set
-	// then no limits are imposed.
+	// then no limits are imposed. Requests waiting for a slot are served by
+	// decreasing priority and then in the order in which they started waiting.
 	Limit uint
 
+	// LimitTimeout bounds the time spent by a request waiting for a slot when
+	// Limit is reached, after which the request fails with a LimitExceeded
+	// error. If not set then requests wait until a slot is available or until
+	// their context is done.
+	LimitTimeout time.Duration
+
+	// MaxQueue is the maximum number of requests waiting for a slot when Limit
+	// is reached. Requests beyond that fail immediately with a LimitExceeded
+	// error. If not set then the number of waiting requests is unbounded.
+	MaxQueue int
+
+	// RateLimit limits the rate of the requests sent by this client across
+	// all hosts. If not set then the rate is not limited.
+	RateLimit *RateLimiter
+
+	// HostRateLimit limits the rate of the requests sent by this client to
+	// each host separately. If not set then the rate is not limited.
+	HostRateLimit *RateLimiter
+
+	// Auth authenticates every attempt of the requests originating from this
+	// client. If the credentials implement Refresher then requests rejected
+	// with a 401 status code are refreshed and sent again once.
+	Auth Credentials
+
+	// Retry is the retry policy applied to all requests originating from this
+	// client. If not set then requests are only attempted once.
+	Retry *RetryPolicy
+
+	// Hosts is a list of addresses of replicated REST endpoints. If set then
+	// Host is ignored and each attempt of a request is sent to one of the
+	// healthy hosts as selected by Balancer. Must be set before calling Init.
+	Hosts []string
+
+	// Resolver supplies the set of hosts when it changes at runtime. If set
+	// then Host and Hosts are ignored and the set of hosts is queried for each
+	// attempt of a request. Defaults to a StaticResolver for Hosts.
+	Resolver Resolver
+
+	// Balancer selects the host of each attempt when Hosts or Resolver is
+	// set. Defaults to RoundRobin.
+	Balancer Balancer
+
+	// MaxFailures is the number of consecutive SendRequestError after which a
+	// host is ejected from the set of healthy hosts. If not set then hosts are
+	// never ejected.
+	MaxFailures int
+
+	// EjectDuration is the duration for which a host is ejected. Defaults to
+	// DefaultEjectDuration.
+	EjectDuration time.Duration
+
+	// Breaker is an optional circuit breaker which fails requests fast when
+	// their host is degraded. Its state can be queried for monitoring.
+	Breaker *CircuitBreaker
+
+	// Hedge is the hedging policy applied to all idempotent requests
+	// originating from this client. If not set then requests are not hedged.
+	Hedge *HedgePolicy
+
+	// ErrorDecoders convert the responses with an error status code into
+	// custom errors which are wrapped in the StatusError returned by
+	// Response.GetBody. The first decoder to return a non-nil error wins.
+	ErrorDecoders []ErrorDecoder
+
+	// Interceptors wrap the sending of every request originating from this
+	// client. The first interceptor is the outermost one.
+	Interceptors []Interceptor
+
+	// ETags is an optional cache used to send GET requests conditionally. It
+	// runs after all the Interceptors.
+	ETags *ETagCache
+
 	initialize sync.Once
 
-	limit chan struct{}
+	limiter limiter
+
+	mutex     sync.Mutex
+	hosts     []string
+	endpoints []*Endpoint
+
+	latencies latencyTracker
 }
 
-// NewRequest creates a new Request object for the given HTTP method.
-func (client *Client) NewRequest(method string) *Request {
-	client.initialize.Do(func() {
-		if client.Client == nil {
-			client.Client = http.DefaultClient
+// Init initializes the object.
+func (client *Client) Init() {
+	client.initialize.Do(client.init)
+}
+
+func (client *Client) init() {
+	if client.Client == nil {
+		client.Client = http.DefaultClient
+	}
+
+	client.limiter.capacity = int(client.Limit)
+	client.limiter.maxQueue = client.MaxQueue
+	client.limiter.timeout = client.LimitTimeout
+
+	if client.Balancer == nil {
+		client.Balancer = new(RoundRobin)
+	}
+
+	if client.Resolver == nil && len(client.Hosts) > 0 {
+		client.Resolver = StaticResolver(client.Hosts)
+	}
+}
+
+// InFlight returns the number of requests of the client currently being sent.
+func (client *Client) InFlight() int {
+	inFlight, _ := client.limiter.counts()
+	return inFlight
+}
+
+// Queued returns the number of requests of the client currently waiting for a
+// slot because Limit is reached.
+func (client *Client) Queued() int {
+	_, queued := client.limiter.counts()
+	return queued
+}
+
+// Endpoints returns the state of the hosts currently supplied by the Resolver
+// of the client.
+func (client *Client) Endpoints() []*Endpoint {
+	client.Init()
+	return client.resolve()
+}
+
+// resolve returns the endpoints matching the current set of hosts of the
+// resolver. The state of the endpoints is preserved across changes of the set.
+func (client *Client) resolve() []*Endpoint {
+	if client.Resolver == nil {
+		return nil
+	}
+
+	hosts := client.Resolver.Hosts()
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if equalHosts(hosts, client.hosts) {
+		return client.endpoints
+	}
+
+	existing := make(map[string]*Endpoint)
+	for _, endpoint := range client.endpoints {
+		existing[endpoint.Addr] = endpoint
+	}
+
+	endpoints := make([]*Endpoint, 0, len(hosts))
+	for _, host := range hosts {
+		endpoint, ok := existing[host]
+		if !ok {
+			endpoint = &Endpoint{Addr: host}
 		}
+		endpoints = append(endpoints, endpoint)
+	}
 
-		if client.Limit > 0 {
-			client.limit = make(chan struct{}, client.Limit)
+	client.hosts = hosts
+	client.endpoints = endpoints
+	return endpoints
+}
 
-			for i := uint(0); i < client.Limit; i++ {
-				client.end()
-			}
+func equalHosts(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
+	}
+	return true
+}
 
-	})
+// NewRequest creates a new Request object for the given HTTP method.
+func (client *Client) NewRequest(method string) *Request {
+	client.Init()
 
 	headers := make(http.Header)
 	if client.Header != nil {
@@ -72,27 +229,125 @@ func (client *Client) NewRequest(method string) *Request {
 		}
 	}
 
+	host := client.Host
+	if client.Resolver != nil {
+		host = ""
+	}
+
 	return &Request{
 		REST:      client,
 		Client:    client.Client,
-		Host:      client.Host,
+		Host:      host,
 		Method:    method,
 		Root:      client.Root,
 		Header:    headers,
 		GzipLevel: client.GzipLevel,
+		Retry:     client.Retry,
+		Hedge:     client.Hedge,
 	}
 }
 
-func (client *Client) begin() {
-	if client.limit != nil {
-		<-client.limit
+// NewRouteRequest creates a new Request object for the method of the given
+// route with a path built from the route's path and the given arguments.
+func (client *Client) NewRouteRequest(route *Route, args ...interface{}) *Request {
+	req := client.NewRequest(route.Method).SetPathArgs(route.Path, args...)
+	req.Route = route
+	return req
+}
+
+// selectEndpoint returns the endpoint to which the request should be sent or
+// nil if the resolver has no hosts. Excluded endpoints and endpoints whose
+// circuit is open are skipped. If all the endpoints are skipped then the
+// selection is made among all the endpoints.
+func (client *Client) selectEndpoint(req *Request, exclude []string) *Endpoint {
+	endpoints := client.resolve()
+	if len(endpoints) == 0 {
+		return nil
+	}
+
+	healthy := make([]*Endpoint, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if !endpoint.Healthy() {
+			continue
+		}
+
+		if containsHost(exclude, endpoint.Addr) {
+			continue
+		}
+
+		if client.Breaker != nil && !client.Breaker.available(client.Breaker.key(req, endpoint.Addr)) {
+			continue
+		}
+
+		healthy = append(healthy, endpoint)
+	}
+
+	if len(healthy) == 0 {
+		healthy = endpoints
 	}
+
+	return client.Balancer.Select(req, healthy)
 }
 
-func (client *Client) end() {
-	if client.limit != nil {
-		client.limit <- struct{}{}
+func containsHost(hosts []string, host string) bool {
+	for _, other := range hosts {
+		if other == host {
+			return true
+		}
 	}
+	return false
+}
+
+// throttle waits until the rate limiters of the client allow a request to be
+// sent to the given host.
+func (client *Client) throttle(ctx context.Context, host string) *Error {
+	if client.RateLimit != nil {
+		if err := client.RateLimit.wait(ctx, ""); err != nil {
+			return err
+		}
+	}
+
+	if client.HostRateLimit != nil {
+		if err := client.HostRateLimit.wait(ctx, host); err != nil {
+			if client.RateLimit != nil {
+				client.RateLimit.cancel("")
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unthrottle returns the tokens taken by throttle for a request which wasn't
+// sent.
+func (client *Client) unthrottle(host string) {
+	if client.RateLimit != nil {
+		client.RateLimit.cancel("")
+	}
+
+	if client.HostRateLimit != nil {
+		client.HostRateLimit.cancel(host)
+	}
+}
+
+func (client *Client) begin(ctx context.Context, req *Request, endpoint *Endpoint) *Error {
+	if err := client.limiter.acquire(ctx, req.Priority); err != nil {
+		return err
+	}
+
+	if endpoint != nil {
+		endpoint.begin()
+	}
+	return nil
+}
+
+func (client *Client) end(endpoint *Endpoint) {
+	if endpoint != nil {
+		endpoint.end()
+	}
+
+	client.limiter.release()
 }
 
 // Request is used to gradually construct REST requests and send them to a
@@ -110,17 +365,31 @@ type Request struct {
 	Client *http.Client
 
 	// Host is the address of the remote REST endpoint where requests should be
-	// sent to.
+	// sent to. If empty then the host is selected for each attempt from the
+	// hosts supplied by the Resolver of the originating client.
 	Host string
 
 	// Root is a prefix that will be preprended to all path requests created by
 	// this client.
 	Root string
 
+	// Key is used by the ConsistentHash balancer to select the host of the
+	// request. Can be changed via the SetKey method.
+	Key string
+
 	// Path is the absolute path where the Request should be routed to on the
 	// remote endpoint. Can be changed via the SetPath method.
 	Path string
 
+	// Route is the route used to build Path if the request was created via
+	// Client.NewRouteRequest. Can be nil.
+	Route *Route
+
+	// Priority orders the requests waiting for a slot of Client.Limit: higher
+	// priorities are served first. Defaults to 0 and can be changed via the
+	// SetPriority method.
+	Priority int
+
 	// Query contains the url parameters and values that will be sent with the
 	// request. Paramerters can be added via the AddParam method.
 	Query url.Values
@@ -139,9 +408,44 @@ type Request struct {
 	// SetBody method.
 	Body []byte
 
+	// Progress is called as the body of the request is being sent. Can be
+	// set via the SetProgress method.
+	Progress ProgressFunc
+
+	// Streaming leaves the body of successful responses open in
+	// Response.Stream instead of reading it into Response.Body. Streamed
+	// requests are never hedged. Can be changed via the SetStreaming method.
+	Streaming bool
+
+	// Expected is the list of status codes expected by the caller. If set
+	// then Response.GetBody reports all other status codes as errors. Can be
+	// changed via the Expect method.
+	Expected []int
+
+	// Targets holds the objects into which Response.GetBody unmarshals the
+	// body of the response for specific status codes. Can be changed via the
+	// ExpectBody method.
+	Targets map[int]interface{}
+
+	// Retry is the retry policy used when an attempt fails. Defaults to the
+	// policy of the originating client and can be changed via the SetRetry
+	// method.
+	Retry *RetryPolicy
+
+	// Hedge is the hedging policy used if the request is idempotent. Defaults
+	// to the policy of the originating client and can be changed via the
+	// SetHedge method.
+	Hedge *HedgePolicy
+
 	HTTP *http.Request
 
 	err *Error
+
+	ctx context.Context
+
+	body       bodyFunc
+	bodyLength int64
+	bodyReplay bool
 }
 
 // NewRequest creates a new Request object to be sent to the given host using
@@ -160,6 +464,13 @@ func (req *Request) SetHost(host string) *Request {
 	return req
 }
 
+// SetKey sets the key used to select the host of the request when balancing
+// requests via ConsistentHash.
+func (req *Request) SetKey(key string) *Request {
+	req.Key = key
+	return req
+}
+
 // SetClient selects the http.Client to be used to execute the requests.
 func (req *Request) SetClient(client *http.Client) *Request {
 	req.Client = client
@@ -173,12 +484,98 @@ func (req *Request) SetPath(path string, args ...interface{}) *Request {
 	return req
 }
 
+// SetPathArgs builds the path where the request will be routed to from the
+// given templated path and arguments. Arguments are escaped before being
+// inserted in the path and the root is prefixed to the resulting path. See
+// Path.Format for further details.
+func (req *Request) SetPathArgs(path Path, args ...interface{}) *Request {
+	if formatted, err := path.Format(args...); err == nil {
+		req.Path = JoinPath(req.Root, formatted)
+	} else {
+		req.err = &Error{NewRequestError, err}
+	}
+	return req
+}
+
+// SetPriority sets the priority of the request when waiting for a slot of
+// Client.Limit.
+func (req *Request) SetPriority(priority int) *Request {
+	req.Priority = priority
+	return req
+}
+
 // SetGzipLevel sets the compression level, must be called before SetBody.
 func (req *Request) SetGzipLevel(level int) *Request {
 	req.GzipLevel = level
 	return req
 }
 
+// Expect adds the given status codes to the list of codes expected by the
+// caller. Response.GetBody doesn't report expected status codes as errors and
+// only unmarshals the body of expected 2xx responses. All other status codes
+// are reported as errors.
+func (req *Request) Expect(codes ...int) *Request {
+	req.Expected = append(req.Expected, codes...)
+	return req
+}
+
+// ExpectBody expects the given status code and sets the object into which
+// Response.GetBody unmarshals the body of responses with that code instead of
+// the object passed to GetBody. Unlike Expect, the other status codes are
+// still handled as if the code wasn't expected.
+func (req *Request) ExpectBody(code int, obj interface{}) *Request {
+	if req.Targets == nil {
+		req.Targets = make(map[int]interface{})
+	}
+
+	req.Targets[code] = obj
+	return req
+}
+
+// expect returns the object into which the body of a response with the given
+// status code should be unmarshalled and whether the status code is expected.
+func (req *Request) expect(code int, obj interface{}) (interface{}, bool) {
+	if target, ok := req.Targets[code]; ok {
+		return target, true
+	}
+
+	for _, expected := range req.Expected {
+		if expected != code {
+			continue
+		}
+
+		if code >= 200 && code < 300 {
+			return obj, true
+		}
+		return nil, true
+	}
+
+	return obj, false
+}
+
+// SetStreaming enables or disables the streaming of the response body. The
+// stream of a successful response must be consumed via one of the ReadXxx
+// methods of Response or closed via Response.Close. Note that the slot of
+// Client.Limit is released once the headers of the response are received.
+func (req *Request) SetStreaming(streaming bool) *Request {
+	req.Streaming = streaming
+	return req
+}
+
+// SetRetry sets the retry policy used when an attempt fails. A nil policy
+// disables retries.
+func (req *Request) SetRetry(policy *RetryPolicy) *Request {
+	req.Retry = policy
+	return req
+}
+
+// SetHedge sets the hedging policy of the request. A nil policy disables
+// hedging.
+func (req *Request) SetHedge(policy *HedgePolicy) *Request {
+	req.Hedge = policy
+	return req
+}
+
 // AddParam adds a parameter to the query string.
 func (req *Request) AddParam(key, value string) *Request {
 	if req.Query == nil {
@@ -231,57 +628,356 @@ func (req *Request) SetRawBody(obj json.RawMessage) *Request {
 	return req
 }
 
+// SetBodyReader sets the given reader as the body of the request which is
+// streamed as the request is sent instead of being buffered. If GzipLevel is
+// set then the body is compressed on the fly. Readers implementing io.Seeker
+// are rewound for every attempt of the request while other readers disable
+// retries and hedging. The content type defaults to application/json and can
+// be changed via the Content-Type header.
+func (req *Request) SetBodyReader(reader io.Reader) *Request {
+	req.bodyLength = readerLength(reader)
+	req.body, req.bodyReplay = replay(reader)
+
+	return req
+}
+
+// SetMultipart sets the given multipart body as the body of the request along
+// with its Content-Type header. The body is streamed as the request is sent.
+func (req *Request) SetMultipart(body *Multipart) *Request {
+	if body.err != nil {
+		req.err = body.err
+	}
+
+	req.body, req.bodyLength, req.bodyReplay = body.open, -1, body.replayable()
+
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set("Content-Type", body.ContentType())
+
+	return req
+}
+
+// SetProgress sets the callback called as the body of the request is being
+// sent.
+func (req *Request) SetProgress(progress ProgressFunc) *Request {
+	req.Progress = progress
+	return req
+}
+
+// replayable indicates whether the body of the request can be sent more than
+// once.
+func (req *Request) replayable() bool {
+	return req.body == nil || req.bodyReplay
+}
+
+// bodyReader returns the reader of the body for an attempt of the request and
+// its length or -1 if unknown.
+func (req *Request) bodyReader() (io.Reader, int64, error) {
+	var reader io.Reader
+	var length int64
+
+	if req.body != nil {
+		var err error
+		if reader, err = req.body(); err != nil {
+			return nil, 0, err
+		}
+		length = req.bodyLength
+
+	} else if len(req.Body) > 0 {
+		reader, length = bytes.NewReader(req.Body), int64(len(req.Body))
+
+	} else {
+		return nil, 0, nil
+	}
+
+	if req.Progress != nil {
+		reader = &progressReader{Reader: reader, progress: req.Progress, total: length}
+	}
+
+	if req.gzipped() {
+		reader, length = gzipReader(reader, req.GzipLevel), -1
+	}
+
+	return reader, length, nil
+}
+
+// gzipped indicates whether the body of the request is compressed as it's
+// sent.
+func (req *Request) gzipped() bool {
+	return req.body != nil && req.GzipLevel != 0
+}
+
 // Send attempts to send the request to the remote endpoint and returns a
-// Response which contains the result.
+// Response which contains the result. Failed attempts are retried according
+// to the retry policy of the request.
 func (req *Request) Send() *Response {
+	return req.SendContext(context.Background())
+}
+
+// SendContext is equivalent to Send but the given context bounds the whole
+// request: the wait for a Client.Limit slot, the HTTP round-trip, the reading
+// of the response body and the delays between retries. If the context expires
+// or is canceled then the response will contain a DeadlineError or a
+// CanceledError. Requests originating from a client are sent through the
+// interceptors of the client.
+func (req *Request) SendContext(ctx context.Context) *Response {
 	t0 := time.Now()
+	req.ctx = ctx
 
 	if len(req.Path) == 0 {
 		req.Path = req.Root
 	}
 
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	if len(req.Header.Get("Content-Type")) == 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if req.Retry != nil && req.Retry.RetryNonIdempotent && !IsIdempotent(req.Method) &&
+		len(req.Header.Get(IdempotencyKeyHeader)) == 0 {
+		req.Header.Set(IdempotencyKeyHeader, NewIdempotencyKey())
+	}
+
 	resp := &Response{Request: req, Error: req.err}
 
 	if resp.Error == nil {
-		if req.REST != nil {
-			req.REST.begin()
+		if req.REST != nil && (len(req.REST.Interceptors) > 0 || req.REST.ETags != nil) {
+			resp = req.REST.intercept(ctx, req, func(ctx context.Context, req *Request) *Response {
+				return req.attempts(ctx)
+			})
+		} else {
+			resp = req.attempts(ctx)
 		}
+	}
 
-		req.send(resp)
+	if resp.http != nil {
+		req.HTTP = resp.http
+	}
 
-		if req.REST != nil {
-			req.REST.end()
+	resp.Latency = time.Since(t0)
+	return resp
+}
+
+// attempts sends the request until an attempt succeeds or the retry policy of
+// the request gives up.
+func (req *Request) attempts(ctx context.Context) (resp *Response) {
+	req.ctx = ctx
+	var latencies []time.Duration
+
+	for attempt := 1; ; attempt++ {
+		t0 := time.Now()
+
+		if req.Hedge != nil && IsIdempotent(req.Method) && !req.Streaming && req.body == nil {
+			resp = req.hedge(ctx)
+		} else {
+			resp = req.attempt(ctx, nil)
+		}
+
+		latencies = append(latencies, time.Since(t0))
+		resp.Attempts = attempt
+		resp.AttemptLatencies = latencies
+
+		if !req.Retry.retryable(req, resp, attempt) || !req.replayable() {
+			return
+		}
+
+		delay, ok := req.Retry.backoff(resp, attempt)
+		if !ok {
+			return
+		}
+
+		resp.Close()
+
+		if err := sleep(ctx, delay); err != nil {
+			resp.Error = err
+			return
 		}
 	}
+}
+
+// Context returns the context of the request which is set when the request is
+// sent. Defaults to context.Background.
+func (req *Request) Context() context.Context {
+	if req.ctx == nil {
+		return context.Background()
+	}
+	return req.ctx
+}
+
+func (req *Request) attempt(ctx context.Context, exclude []string) *Response {
+	resp, endpoint := req.target(exclude)
+	if resp.Error != nil {
+		return resp
+	}
+	return req.attemptTo(ctx, resp, endpoint)
+}
+
+// target selects the host of the next attempt while avoiding, if possible, the
+// excluded hosts.
+func (req *Request) target(exclude []string) (*Response, *Endpoint) {
+	resp := &Response{Request: req, Host: req.Host}
+
+	if req.REST == nil || len(resp.Host) > 0 || req.REST.Resolver == nil {
+		return resp, nil
+	}
+
+	endpoint := req.REST.selectEndpoint(req, exclude)
+	if endpoint == nil {
+		resp.Error = ErrorFmt(NoHostsError, "no hosts available")
+		return resp, nil
+	}
+
+	resp.Host = endpoint.Addr
+	return resp, endpoint
+}
+
+func (req *Request) attemptTo(ctx context.Context, resp *Response, endpoint *Endpoint) *Response {
+	if req.REST == nil {
+		req.send(ctx, resp)
+		return resp
+	}
+
+	// The circuit is checked first such that requests to a degraded host fail
+	// fast instead of waiting for a token or a slot.
+	var breaker *ticket
+	if req.REST.Breaker != nil {
+		var ok bool
+		key := req.REST.Breaker.key(req, resp.Host)
+		if breaker, ok = req.REST.Breaker.allow(key); !ok {
+			resp.Error = ErrorFmt(CircuitOpen, "circuit open for '%s'", key)
+			return resp
+		}
+	}
+
+	abort := func() {
+		if breaker != nil {
+			req.REST.Breaker.release(breaker)
+		}
+	}
+
+	if resp.Error = req.REST.throttle(ctx, resp.Host); resp.Error != nil {
+		abort()
+		return resp
+	}
+
+	if resp.Error = req.REST.begin(ctx, req, endpoint); resp.Error != nil {
+		req.REST.unthrottle(resp.Host)
+		abort()
+		return resp
+	}
+
+	t0 := time.Now()
+	req.send(ctx, resp)
+
+	if refresher, ok := req.REST.Auth.(Refresher); ok && resp.Code == http.StatusUnauthorized && req.replayable() {
+		refresher.Refresh(resp.http)
+
+		retry := &Response{Request: req, Host: resp.Host}
+		req.send(ctx, retry)
+		*resp = *retry
+	}
+
+	latency := time.Since(t0)
+
+	req.REST.end(endpoint)
+
+	if req.REST.RateLimit != nil {
+		req.REST.RateLimit.record("", resp)
+	}
+
+	if req.REST.HostRateLimit != nil {
+		req.REST.HostRateLimit.record(resp.Host, resp)
+	}
+
+	if endpoint != nil {
+		endpoint.record(resp, req.REST.MaxFailures, req.REST.EjectDuration)
+	}
+
+	if breaker != nil {
+		req.REST.Breaker.record(breaker, resp, latency)
+	}
+
+	if req.Hedge != nil && resp.Error == nil {
+		req.REST.latencies.record(latency)
+	}
 
-	resp.Latency = time.Since(t0)
 	return resp
 }
 
-func (req *Request) send(resp *Response) {
-	var reader io.Reader
-	if len(req.Body) > 0 {
-		reader = bytes.NewReader(req.Body)
+// sleep waits for the given delay or until the context is done in which case
+// the error of the context is returned.
+func sleep(ctx context.Context, delay time.Duration) *Error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return contextError(ctx)
+	}
+}
+
+// contextError converts the error of a context into an Error object or nil if
+// the context is not done.
+func contextError(ctx context.Context) *Error {
+	switch err := ctx.Err(); err {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return &Error{DeadlineError, err}
+	default:
+		return &Error{CanceledError, err}
+	}
+}
+
+func (req *Request) send(ctx context.Context, resp *Response) {
+	reader, length, err := req.bodyReader()
+	if err != nil {
+		resp.Error = &Error{NewRequestError, err}
+		return
 	}
 
-	urlS := strings.TrimRight(req.Host, "/") + req.Path
+	urlS := strings.TrimRight(resp.Host, "/") + req.Path
 
 	if req.Query != nil {
 		urlS += "?" + req.Query.Encode()
 	}
 
-	var err error
-
-	if req.HTTP, err = http.NewRequest(req.Method, urlS, reader); err != nil {
+	if resp.http, err = http.NewRequestWithContext(ctx, req.Method, urlS, reader); err != nil {
+		closeReader(reader)
 		resp.Error = &Error{NewRequestError, err}
 		return
 	}
 
-	req.AddHeader("Content-Type", "application/json")
-	req.HTTP.Header = req.Header
+	if length > 0 {
+		resp.http.ContentLength = length
+	}
+
+	// Attempts can be sent concurrently when hedging so each attempt gets its
+	// own copy of the headers.
+	resp.http.Header = req.Header.Clone()
+
+	if req.gzipped() {
+		resp.http.Header.Set("Content-Encoding", "gzip")
+	}
+
+	if req.REST != nil && req.REST.Auth != nil {
+		if err := req.REST.Auth.Authorize(req, resp.http); err != nil {
+			closeReader(reader)
+			resp.Error = &Error{CredentialsError, err}
+			return
+		}
+	}
 
-	httpResp, err := req.Client.Do(req.HTTP)
+	httpResp, err := req.Client.Do(resp.http)
 	if err != nil {
+		if resp.Error = contextError(ctx); resp.Error != nil {
+			return
+		}
 		if err2, ok := err.(*url.Error); ok {
 			if err3, ok := err2.Err.(net.Error); ok {
 				if err3.Timeout() {
@@ -297,8 +993,15 @@ func (req *Request) send(resp *Response) {
 	resp.Code = httpResp.StatusCode
 	resp.Header = httpResp.Header
 
+	if req.Streaming && resp.Code >= 200 && resp.Code < 300 {
+		resp.Stream = httpResp.Body
+		return
+	}
+
 	if resp.Body, err = ioutil.ReadAll(httpResp.Body); err != nil {
-		resp.Error = &Error{ReadBodyError, err}
+		if resp.Error = contextError(ctx); resp.Error == nil {
+			resp.Error = &Error{ReadBodyError, err}
+		}
 	}
 
 	httpResp.Body.Close()
@@ -312,6 +1015,9 @@ type Response struct {
 	// Request is the request that originated the response.
 	Request *Request
 
+	// Host is the address of the host to which the last attempt was sent.
+	Host string
+
 	// Code is the http status code returned by the endpoint.
 	Code int
 
@@ -322,27 +1028,61 @@ type Response struct {
 	// used to unmarshal the body.
 	Body []byte
 
+	// Stream is the open body of a successful response to a streamed request.
+	// Nil if the request isn't streamed or if the response failed in which
+	// case the body is available in Body.
+	Stream io.ReadCloser
+
 	// Error is set if an error occured while sending the request.
 	Error *Error
 
-	// Latency indicates how long the request round-trip took.
+	// Latency indicates how long the request round-trip took, including all
+	// the attempts and the delays between them.
 	Latency time.Duration
+
+	// Attempts is the number of attempts made to send the request.
+	Attempts int
+
+	// AttemptLatencies holds the round-trip latency of each attempt.
+	AttemptLatencies []time.Duration
+
+	// Hedges is the number of hedged requests sent in addition to the
+	// original request during the last attempt.
+	Hedges int
+
+	// NotModified indicates that the endpoint responded with a 304 status
+	// code and that the body was taken from the Client.ETags cache.
+	NotModified bool
+
+	http *http.Request
 }
 
 // GetBody checks the various fields of the response for errors and unmarshals
 // the response body if the given object is not nil. If an error is detected,
-// the error type and error will be returned instead.
+// the error type and error will be returned instead. Error status codes are
+// reported as an UnknownRoute or EndpointError wrapping a StatusError which
+// can be extracted via errors.As. Other status codes outside of the 2xx range
+// or not expected via Request.Expect are reported as UnexpectedStatusCode.
 func (resp *Response) GetBody(obj interface{}) (err *Error) {
+	expected, restricted := false, false
+	if resp.Request != nil {
+		obj, expected = resp.Request.expect(resp.Code, obj)
+		restricted = len(resp.Request.Expected) > 0
+	}
+
 	if resp.Error != nil {
 		err = resp.Error
 
-	} else if resp.Code == http.StatusNotFound {
-		err = &Error{UnknownRoute, errors.New(string(resp.Body))}
+	} else if expected && (obj == nil || len(resp.Body) == 0) {
+		return
+
+	} else if !expected && resp.Code == http.StatusNotFound {
+		err = &Error{UnknownRoute, resp.statusError()}
 
-	} else if resp.Code >= 400 {
-		err = &Error{EndpointError, errors.New(string(resp.Body))}
+	} else if !expected && resp.Code >= 400 {
+		err = &Error{EndpointError, resp.statusError()}
 
-	} else if resp.Code < 200 && resp.Code >= 300 {
+	} else if !expected && (restricted || resp.Code < 200 || resp.Code >= 300) {
 		err = ErrorFmt(UnexpectedStatusCode, "unexpected status code: %d", resp.Code)
 
 	} else if resp.Code == http.StatusNoContent {
@@ -363,3 +1103,21 @@ func (resp *Response) GetBody(obj interface{}) (err *Error) {
 
 	return
 }
+
+// statusError returns the error of a response with an error status code as
+// decoded by the error decoders of the originating client.
+func (resp *Response) statusError() *StatusError {
+	err := &StatusError{Code: resp.Code, Header: resp.Header, Body: resp.Body}
+
+	if resp.Request == nil || resp.Request.REST == nil {
+		return err
+	}
+
+	for _, decoder := range resp.Request.REST.ErrorDecoders {
+		if err.Err = decoder(resp); err.Err != nil {
+			break
+		}
+	}
+
+	return err
+}
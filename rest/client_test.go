@@ -0,0 +1,1291 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newFlakyServer returns a server which fails the first n requests with the
+// given status code before responding with a JSON body.
+func newFlakyServer(n int32, code int, header http.Header) (*httptest.Server, *int32) {
+	count := new(int32)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(count, 1) <= n {
+			for key, val := range header {
+				writer.Header()[key] = val
+			}
+			http.Error(writer, "flaky", code)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write([]byte(`"ok"`))
+	}))
+
+	return server, count
+}
+
+func TestClientRetry(t *testing.T) {
+	server, count := newFlakyServer(2, http.StatusServiceUnavailable, nil)
+	defer server.Close()
+
+	client := &Client{
+		Host:  server.URL,
+		Limit: 1,
+		Retry: &RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, Jitter: 0.5},
+	}
+
+	var result string
+	resp := client.NewRequest("GET").SetPath("/").Send()
+	if err := resp.GetBody(&result); err != nil {
+		t.Errorf("FAIL(retry): unexpected error %s", err)
+	}
+
+	if resp.Attempts != 3 || len(resp.AttemptLatencies) != 3 || atomic.LoadInt32(count) != 3 {
+		t.Errorf("FAIL(retry): unexpected attempts: %d, %d, %d", resp.Attempts, len(resp.AttemptLatencies), atomic.LoadInt32(count))
+	}
+
+	atomic.StoreInt32(count, 0)
+	resp = client.NewRequest("POST").SetPath("/").Send()
+	if resp.Attempts != 1 || resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("FAIL(post): unexpected retry: %d -> %d", resp.Attempts, resp.Code)
+	}
+
+	atomic.StoreInt32(count, 0)
+	resp = client.NewRequest("GET").SetPath("/").SetRetry(nil).Send()
+	if resp.Attempts != 1 {
+		t.Errorf("FAIL(no-retry): unexpected attempts: %d", resp.Attempts)
+	}
+}
+
+func TestRetryJitter(t *testing.T) {
+	for _, jitter := range []float64{-1, 0.5, 5} {
+		policy := &RetryPolicy{MinBackoff: time.Second, Jitter: jitter}
+
+		for i := 0; i < 100; i++ {
+			if delay, ok := policy.backoff(&Response{}, 1); !ok || delay < 0 || delay > time.Second {
+				t.Fatalf("FAIL(%v): unexpected delay: %s %v", jitter, delay, ok)
+			}
+		}
+	}
+}
+
+func TestRetryConflict(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 3}
+	req := (&Client{}).NewRequest("PUT").SetIdempotencyKey("key")
+
+	inFlight := &Response{Code: http.StatusConflict, Header: http.Header{"Retry-After": {"1"}}}
+	if !policy.retryable(req, inFlight, 1) {
+		t.Errorf("FAIL(in-flight): conflict not retried")
+	}
+
+	if policy.retryable(req, &Response{Code: http.StatusConflict, Header: http.Header{}}, 1) {
+		t.Errorf("FAIL(handler): conflict retried")
+	}
+
+	if policy.retryable((&Client{}).NewRequest("PUT"), inFlight, 1) {
+		t.Errorf("FAIL(no-key): conflict retried")
+	}
+}
+
+func TestClientRetryAfter(t *testing.T) {
+	header := http.Header{"Retry-After": {"3600"}}
+	server, _ := newFlakyServer(1, http.StatusTooManyRequests, header)
+	defer server.Close()
+
+	client := &Client{
+		Host:  server.URL,
+		Retry: &RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond},
+	}
+
+	resp := client.NewRequest("GET").SetPath("/").Send()
+	if resp.Attempts != 1 || resp.Code != http.StatusTooManyRequests {
+		t.Errorf("FAIL(retry-after): unexpected retry: %d -> %d", resp.Attempts, resp.Code)
+	}
+
+	if delay, ok := resp.RetryAfter(); !ok || delay != time.Hour {
+		t.Errorf("FAIL(retry-after): unexpected delay: %s", delay)
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	client := &Client{Host: server.URL, Limit: 1}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	resp := client.NewRequest("GET").SendContext(ctx)
+	if resp.Error == nil || resp.Error.Type != DeadlineError {
+		t.Errorf("FAIL(deadline): unexpected error: %v", resp.Error)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	resp = client.NewRequest("GET").SendContext(ctx)
+	if resp.Error == nil || resp.Error.Type != CanceledError {
+		t.Errorf("FAIL(cancel): unexpected error: %v", resp.Error)
+	}
+
+	// Hold the only slot of the client to force the next request to wait.
+	client.begin(context.Background(), new(Request), nil)
+	defer client.end(nil)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	resp = client.NewRequest("GET").SendContext(ctx)
+	if resp.Error == nil || resp.Error.Type != DeadlineError || resp.Code != 0 {
+		t.Errorf("FAIL(limit): unexpected response: %d %v", resp.Code, resp.Error)
+	}
+}
+
+func newEchoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write([]byte(`"ok"`))
+	}))
+}
+
+func TestClientBalancing(t *testing.T) {
+	s0, s1 := newEchoServer(), newEchoServer()
+	defer s0.Close()
+	defer s1.Close()
+
+	dead := newEchoServer()
+	dead.Close()
+
+	client := &Client{
+		Hosts:       []string{s0.URL, dead.URL, s1.URL},
+		MaxFailures: 1,
+	}
+
+	hosts := make(map[string]int)
+	for i := 0; i < 9; i++ {
+		resp := client.NewRequest("GET").Send()
+		hosts[resp.Host]++
+	}
+
+	if hosts[dead.URL] != 1 || hosts[s0.URL] < 3 || hosts[s1.URL] < 3 {
+		t.Errorf("FAIL(round-robin): unexpected distribution: %v", hosts)
+	}
+
+	if endpoint := client.Endpoints()[1]; endpoint.Healthy() {
+		t.Errorf("FAIL(eject): endpoint %s should be ejected", endpoint.Addr)
+	}
+
+	client = &Client{
+		Hosts:    []string{s0.URL, s1.URL},
+		Balancer: new(ConsistentHash),
+	}
+
+	exp := client.NewRequest("GET").SetKey("key").Send().Host
+	for i := 0; i < 10; i++ {
+		if host := client.NewRequest("GET").SetKey("key").Send().Host; host != exp {
+			t.Errorf("FAIL(consistent-hash): unexpected host: %s != %s", host, exp)
+		}
+	}
+}
+
+func TestBalancerOutstanding(t *testing.T) {
+	endpoints := []*Endpoint{{Addr: "a"}, {Addr: "b"}}
+	endpoints[0].begin()
+
+	for _, balancer := range []Balancer{LeastOutstanding{}, PowerOfTwo{}} {
+		if endpoint := balancer.Select(nil, endpoints); endpoint.Addr != "b" {
+			t.Errorf("FAIL(%T): unexpected endpoint: %s", balancer, endpoint.Addr)
+		}
+	}
+}
+
+func TestClientFileResolver(t *testing.T) {
+	s0, s1 := newEchoServer(), newEchoServer()
+	defer s0.Close()
+	defer s1.Close()
+
+	dir, err := ioutil.TempDir("", "gorest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hosts")
+	ioutil.WriteFile(path, []byte("# hosts\n"+s0.URL+"\n\n"), 0644)
+
+	resolver := &FileResolver{Path: path, Interval: time.Millisecond}
+	client := &Client{Resolver: resolver}
+
+	if resp := client.NewRequest("GET").Send(); resp.Host != s0.URL || resp.Error != nil {
+		t.Errorf("FAIL(file): unexpected response: %s %v", resp.Host, resp.Error)
+	}
+
+	// Make sure that the modification time changes.
+	later := time.Now().Add(time.Second)
+	ioutil.WriteFile(path, []byte(s1.URL), 0644)
+	os.Chtimes(path, later, later)
+
+	for i := 0; i < 100; i++ {
+		time.Sleep(time.Millisecond)
+		if resp := client.NewRequest("GET").Send(); resp.Host == s1.URL {
+			return
+		}
+	}
+	t.Errorf("FAIL(file): resolver never picked up the new host")
+}
+
+func TestClientDNSResolver(t *testing.T) {
+	resolver := &DNSResolver{Name: "localhost", Port: 8080}
+
+	hosts := resolver.Hosts()
+	if len(hosts) == 0 {
+		t.Skipf("unable to resolve localhost: %v", resolver.Err())
+	}
+
+	for _, host := range hosts {
+		if !strings.HasPrefix(host, "http://") || !strings.HasSuffix(host, ":8080") {
+			t.Errorf("FAIL(dns): unexpected host: %s", host)
+		}
+	}
+
+	client := &Client{Resolver: StaticResolver{}}
+	if resp := client.NewRequest("GET").Send(); resp.Error == nil || resp.Error.Type != NoHostsError {
+		t.Errorf("FAIL(no-hosts): unexpected error: %v", resp.Error)
+	}
+}
+
+func TestOrderSRV(t *testing.T) {
+	records := []*net.SRV{
+		{Target: "backup", Priority: 20, Weight: 10},
+		{Target: "light", Priority: 10, Weight: 1},
+		{Target: "heavy", Priority: 10, Weight: 99},
+		{Target: "none", Priority: 10, Weight: 0},
+	}
+
+	first := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		ordered := orderSRV(records)
+		if len(ordered) != 4 || ordered[3].Target != "backup" {
+			t.Fatalf("FAIL(priority): unexpected order: %v", ordered)
+		}
+		first[ordered[0].Target]++
+	}
+
+	if first["heavy"] < 900 || first["light"] == 0 {
+		t.Errorf("FAIL(weight): unexpected first targets: %v", first)
+	}
+}
+
+func TestPollerRefresh(t *testing.T) {
+	var poller poller
+	started, release := make(chan struct{}), make(chan struct{})
+
+	go poller.get(time.Minute, func() ([]string, error) {
+		close(started)
+		<-release
+		return []string{"a"}, nil
+	})
+
+	// The lock isn't held during the first refresh.
+	<-started
+	if err := poller.lastError(); err != nil {
+		t.Errorf("FAIL(lock): unexpected error: %s", err)
+	}
+	close(release)
+
+	if hosts := poller.get(time.Minute, nil); len(hosts) != 1 || hosts[0] != "a" {
+		t.Errorf("FAIL(refresh): unexpected hosts: %v", hosts)
+	}
+}
+
+func TestPollerRecovery(t *testing.T) {
+	var poller poller
+	results := [][]string{nil, nil, {"a"}}
+	calls := 0
+
+	refresh := func() ([]string, error) {
+		calls++
+		if calls == 1 {
+			return nil, errors.New("unavailable")
+		}
+		return results[calls-1], nil
+	}
+
+	if hosts := poller.get(time.Minute, refresh); len(hosts) != 0 || poller.lastError() == nil {
+		t.Fatalf("FAIL(failed): unexpected hosts: %v %v", hosts, poller.lastError())
+	}
+
+	// The failed refresh is retried after a short backoff.
+	if hosts := poller.get(time.Minute, refresh); len(hosts) != 0 || calls != 1 {
+		t.Errorf("FAIL(backoff): unexpected refresh: %v %d", hosts, calls)
+	}
+
+	// An empty set of hosts is retried as a failure.
+	time.Sleep(minResolveBackoff + 10*time.Millisecond)
+	if hosts := poller.get(time.Minute, refresh); len(hosts) != 0 || calls != 2 || poller.lastError() == nil {
+		t.Errorf("FAIL(empty): unexpected hosts: %v %d %v", hosts, calls, poller.lastError())
+	}
+
+	time.Sleep(2*minResolveBackoff + 10*time.Millisecond)
+	if hosts := poller.get(time.Minute, refresh); len(hosts) != 1 || hosts[0] != "a" || poller.lastError() != nil {
+		t.Errorf("FAIL(recovered): unexpected hosts: %v %v", hosts, poller.lastError())
+	}
+}
+
+func TestClientCircuitBreaker(t *testing.T) {
+	server, count := newFlakyServer(3, http.StatusInternalServerError, nil)
+	defer server.Close()
+
+	breaker := &CircuitBreaker{MinRequests: 2, OpenDuration: 20 * time.Millisecond}
+	client := &Client{Host: server.URL, Breaker: breaker}
+
+	for i := 0; i < 2; i++ {
+		if resp := client.NewRequest("GET").Send(); resp.Code != http.StatusInternalServerError {
+			t.Errorf("FAIL(closed): unexpected response: %d %v", resp.Code, resp.Error)
+		}
+	}
+
+	if state := breaker.State(server.URL); state != BreakerOpen {
+		t.Errorf("FAIL(open): unexpected state: %s", state)
+	}
+
+	if resp := client.NewRequest("GET").Send(); resp.Error == nil || resp.Error.Type != CircuitOpen {
+		t.Errorf("FAIL(open): unexpected response: %d %v", resp.Code, resp.Error)
+	}
+
+	if n := atomic.LoadInt32(count); n != 2 {
+		t.Errorf("FAIL(open): unexpected request count: %d", n)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if state := breaker.States()[server.URL]; state != BreakerHalfOpen {
+		t.Errorf("FAIL(half-open): unexpected state: %s", state)
+	}
+
+	// The probe fails which reopens the circuit.
+	client.NewRequest("GET").Send()
+	if state := breaker.State(server.URL); state != BreakerOpen {
+		t.Errorf("FAIL(reopen): unexpected state: %s", state)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if resp := client.NewRequest("GET").Send(); resp.Error != nil || resp.Code != http.StatusOK {
+		t.Errorf("FAIL(probe): unexpected response: %d %v", resp.Code, resp.Error)
+	}
+
+	if state := breaker.State(server.URL); state != BreakerClosed {
+		t.Errorf("FAIL(closed): unexpected state: %s", state)
+	}
+}
+
+func TestCircuitBreakerRelease(t *testing.T) {
+	breaker := &CircuitBreaker{MinRequests: 1, OpenDuration: 10 * time.Millisecond}
+
+	probe := func(title string) *ticket {
+		ticket, ok := breaker.allow("host")
+		if !ok {
+			t.Fatalf("FAIL(%s): probe rejected", title)
+		}
+		if _, ok := breaker.allow("host"); ok {
+			t.Errorf("FAIL(%s): too many probes", title)
+		}
+		return ticket
+	}
+
+	ticket, _ := breaker.allow("host")
+	breaker.record(ticket, &Response{Code: http.StatusInternalServerError}, 0)
+
+	time.Sleep(15 * time.Millisecond)
+
+	// A canceled probe says nothing about the host.
+	breaker.record(probe("canceled"), &Response{Error: ErrorFmt(CanceledError, "canceled")}, 0)
+	if state := breaker.State("host"); state != BreakerHalfOpen {
+		t.Errorf("FAIL(canceled): unexpected state: %s", state)
+	}
+
+	breaker.record(probe("deadline"), &Response{Error: ErrorFmt(DeadlineError, "deadline")}, 0)
+	if state := breaker.State("host"); state != BreakerHalfOpen {
+		t.Errorf("FAIL(deadline): unexpected state: %s", state)
+	}
+
+	// A probe which wasn't sent is handed to the next request.
+	breaker.release(probe("release"))
+
+	breaker.record(probe("success"), &Response{Code: http.StatusOK}, 0)
+	if state := breaker.State("host"); state != BreakerClosed {
+		t.Errorf("FAIL(success): unexpected state: %s", state)
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	breaker := &CircuitBreaker{Window: 1, MinRequests: 1}
+
+	ticket, _ := breaker.allow("host")
+	breaker.record(ticket, &Response{Code: http.StatusInternalServerError}, 0)
+	if state := breaker.State("host"); state != BreakerOpen {
+		t.Errorf("FAIL(window): unexpected state: %s", state)
+	}
+}
+
+func TestCircuitBreakerKeys(t *testing.T) {
+	breaker := &CircuitBreaker{Window: 20 * time.Millisecond, PerRoute: true}
+
+	if key := breaker.key(&Request{Method: "GET", Path: "/a/1"}, "host"); key != "host" {
+		t.Errorf("FAIL(path): unexpected key: %s", key)
+	}
+
+	route := &Route{Method: "GET", Path: NewPath("/a/:id")}
+	if key := breaker.key(&Request{Method: "GET", Path: "/a/1", Route: route}, "host"); key != "host GET /a/:id/" {
+		t.Errorf("FAIL(route): unexpected key: %s", key)
+	}
+
+	if state := breaker.State("unknown"); state != BreakerClosed || len(breaker.States()) != 0 {
+		t.Errorf("FAIL(unknown): unexpected state: %s %v", state, breaker.States())
+	}
+
+	ticket, _ := breaker.allow("idle")
+	breaker.record(ticket, &Response{Code: http.StatusOK}, 0)
+
+	time.Sleep(25 * time.Millisecond)
+
+	breaker.allow("active")
+	if states := breaker.States(); len(states) != 1 || states["active"] != BreakerClosed {
+		t.Errorf("FAIL(evict): unexpected states: %v", states)
+	}
+}
+
+// firstBalancer always selects the first available endpoint.
+type firstBalancer struct{}
+
+func (firstBalancer) Select(req *Request, endpoints []*Endpoint) *Endpoint {
+	return endpoints[0]
+}
+
+func TestClientHedge(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+		}
+	}))
+	defer slow.Close()
+
+	fast := newEchoServer()
+	defer fast.Close()
+
+	client := &Client{
+		Hosts:    []string{slow.URL, fast.URL},
+		Balancer: firstBalancer{},
+		Hedge:    &HedgePolicy{Delay: 10 * time.Millisecond},
+	}
+
+	var result string
+	resp := client.NewRequest("GET").Send()
+	if err := resp.GetBody(&result); err != nil {
+		t.Errorf("FAIL(hedge): unexpected error: %s", err)
+	}
+
+	if resp.Hedges != 1 || resp.Host != fast.URL || resp.Latency > 100*time.Millisecond {
+		t.Errorf("FAIL(hedge): unexpected response: hedges=%d host=%s latency=%s", resp.Hedges, resp.Host, resp.Latency)
+	}
+
+	// Non idempotent requests are never hedged.
+	resp = client.NewRequest("POST").SetBody("x").Send()
+	if resp.Hedges != 0 || resp.Host != slow.URL {
+		t.Errorf("FAIL(post): unexpected response: hedges=%d host=%s", resp.Hedges, resp.Host)
+	}
+}
+
+func TestLatencyTracker(t *testing.T) {
+	var tracker latencyTracker
+
+	if _, ok := tracker.percentile(50, 1); ok {
+		t.Errorf("FAIL(empty): unexpected percentile")
+	}
+
+	for i := 1; i <= 100; i++ {
+		tracker.record(time.Duration(i) * time.Millisecond)
+	}
+
+	if p, ok := tracker.percentile(95, 20); !ok || p != 96*time.Millisecond {
+		t.Errorf("FAIL(p95): unexpected percentile: %s", p)
+	}
+}
+
+func TestClientSendBatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/slow":
+			select {
+			case <-req.Context().Done():
+			case <-time.After(time.Second):
+			}
+		case "/fail":
+			http.Error(writer, "fail", http.StatusInternalServerError)
+		default:
+			writer.Header().Set("Content-Type", "application/json")
+			writer.Write([]byte(`"ok"`))
+		}
+	}))
+	defer server.Close()
+
+	client := &Client{Host: server.URL}
+	batch := func(paths ...string) []*Request {
+		var reqs []*Request
+		for _, path := range paths {
+			reqs = append(reqs, client.NewRequest("GET").SetPath(path))
+		}
+		return reqs
+	}
+
+	var result string
+	if err := (<-client.NewRequest("GET").SendAsync(context.Background())).GetBody(&result); err != nil || result != "ok" {
+		t.Errorf("FAIL(async): unexpected result: %s %v", result, err)
+	}
+
+	resps := client.SendAll(batch("/a", "/fail", "/b")...)
+	if len(resps) != 3 || resps[0].Code != 200 || resps[1].Code != 500 || resps[2].Code != 200 {
+		t.Errorf("FAIL(all): unexpected responses: %v", resps)
+	}
+
+	start := time.Now()
+	resps, err := client.SendBatch(context.Background(), Batch{FailFast: true}, batch("/slow", "/fail")...)
+	if err == nil || err.Type != BatchError || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("FAIL(fail-fast): unexpected error: %v", err)
+	} else if resps[0].Error == nil || resps[0].Error.Type != CanceledError {
+		t.Errorf("FAIL(fail-fast): unexpected response: %v", resps[0].Error)
+	}
+
+	start = time.Now()
+	resps, err = client.SendBatch(context.Background(), Batch{Quorum: 2}, batch("/a", "/slow", "/b")...)
+	if err != nil || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("FAIL(quorum): unexpected error: %v", err)
+	} else if resps[1].Error == nil || resps[1].Error.Type != CanceledError {
+		t.Errorf("FAIL(quorum): unexpected response: %v", resps[1].Error)
+	}
+
+	if _, err = client.SendBatch(context.Background(), Batch{Quorum: 2}, batch("/a", "/fail", "/fail")...); err == nil || err.Type != BatchError {
+		t.Errorf("FAIL(no-quorum): unexpected error: %v", err)
+	}
+
+	if _, err = client.SendBatch(context.Background(), Batch{Quorum: 3}, batch("/a", "/b")...); err == nil || err.Type != BatchError {
+		t.Errorf("FAIL(quorum-size): unexpected error: %v", err)
+	}
+
+	other := &Client{Host: server.URL}
+	if _, err = other.SendBatch(context.Background(), Batch{}, batch("/a")...); err == nil || err.Type != BatchError {
+		t.Errorf("FAIL(other-client): unexpected error: %v", err)
+	}
+	if resps := other.SendAll(batch("/a")...); len(resps) != 1 || resps[0].Error == nil || resps[0].Error.Type != BatchError {
+		t.Errorf("FAIL(other-client): unexpected responses: %v", resps)
+	}
+
+	start = time.Now()
+	resps, err = client.SendBatch(context.Background(), Batch{Timeout: 50 * time.Millisecond}, batch("/a", "/slow")...)
+	if err != nil || time.Since(start) > 500*time.Millisecond || resps[0].Code != 200 {
+		t.Errorf("FAIL(timeout): unexpected error: %v", err)
+	} else if resps[1].Error == nil || resps[1].Error.Type != DeadlineError {
+		t.Errorf("FAIL(timeout): unexpected response: %v", resps[1].Error)
+	}
+}
+
+func TestClientInterceptors(t *testing.T) {
+	hits := new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(hits, 1)
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write([]byte(`"` + req.Header.Get("X-Trace") + `"`))
+	}))
+	defer server.Close()
+
+	var trace []string
+
+	client := &Client{
+		Host:   server.URL,
+		Header: http.Header{"X-Trace": []string{"client"}},
+		Limit:  1,
+		Interceptors: []Interceptor{
+			func(ctx context.Context, req *Request, next Sender) *Response {
+				trace = append(trace, "outer:"+req.Header.Get("X-Trace"))
+				resp := next(ctx, req)
+				trace = append(trace, "outer:"+strconv.Itoa(resp.Code))
+				return resp
+			},
+			func(ctx context.Context, req *Request, next Sender) *Response {
+				if req.Path == "/cached" {
+					return &Response{
+						Code:   http.StatusOK,
+						Header: http.Header{"Content-Type": []string{"application/json"}},
+						Body:   []byte(`"cached"`),
+					}
+				}
+				req.Header.Set("X-Trace", "inner")
+				return next(ctx, req)
+			},
+		},
+	}
+
+	var result string
+	if err := client.NewRequest("GET").Send().GetBody(&result); err != nil || result != "inner" {
+		t.Errorf("FAIL(mutate): unexpected result: %s %v", result, err)
+	}
+
+	if len(trace) != 2 || trace[0] != "outer:client" || trace[1] != "outer:200" {
+		t.Errorf("FAIL(order): unexpected trace: %v", trace)
+	}
+
+	resp := client.NewRequest("GET").SetPath("/cached").Send()
+	if err := resp.GetBody(&result); err != nil || result != "cached" || resp.Request == nil {
+		t.Errorf("FAIL(short-circuit): unexpected result: %s %v", result, err)
+	}
+
+	if n := atomic.LoadInt32(hits); n != 1 {
+		t.Errorf("FAIL(short-circuit): unexpected hits: %d", n)
+	}
+}
+
+func TestClientLimit(t *testing.T) {
+	gate := make(chan struct{})
+	order := make(chan string, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/block" {
+			<-gate
+		}
+		order <- req.URL.Path
+	}))
+	defer server.Close()
+
+	client := &Client{Host: server.URL, Limit: 1, MaxQueue: 2}
+
+	waitFor := func(title string, queued int) {
+		for i := 0; client.Queued() != queued; i++ {
+			if i == 100 {
+				t.Fatalf("FAIL(%s): unexpected queue length: %d != %d", title, client.Queued(), queued)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	block := client.NewRequest("GET").SetPath("/block").SendAsync(context.Background())
+	waitFor("block", 0)
+	for client.InFlight() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	low := client.NewRequest("GET").SetPath("/low").SendAsync(context.Background())
+	waitFor("low", 1)
+
+	high := client.NewRequest("GET").SetPath("/high").SetPriority(1).SendAsync(context.Background())
+	waitFor("high", 2)
+
+	if resp := client.NewRequest("GET").Send(); resp.Error == nil || resp.Error.Type != LimitExceeded {
+		t.Errorf("FAIL(max-queue): unexpected error: %v", resp.Error)
+	}
+
+	close(gate)
+	<-block
+	<-low
+	<-high
+
+	if first, second, third := <-order, <-order, <-order; first != "/block" || second != "/high" || third != "/low" {
+		t.Errorf("FAIL(priority): unexpected order: %s %s %s", first, second, third)
+	}
+
+	if client.InFlight() != 0 || client.Queued() != 0 {
+		t.Errorf("FAIL(counters): unexpected counters: %d %d", client.InFlight(), client.Queued())
+	}
+
+	client = &Client{Host: server.URL, Limit: 1, LimitTimeout: 10 * time.Millisecond}
+	client.Init()
+	client.limiter.acquire(context.Background(), 0)
+
+	if resp := client.NewRequest("GET").Send(); resp.Error == nil || resp.Error.Type != LimitExceeded {
+		t.Errorf("FAIL(timeout): unexpected error: %v", resp.Error)
+	}
+}
+
+func TestClientRateLimit(t *testing.T) {
+	server := newEchoServer()
+	defer server.Close()
+
+	client := &Client{Host: server.URL, RateLimit: &RateLimiter{Rate: 50, Burst: 2}}
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if resp := client.NewRequest("GET").Send(); resp.Error != nil {
+			t.Errorf("FAIL(wait): unexpected error: %s", resp.Error)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 70*time.Millisecond {
+		t.Errorf("FAIL(wait): requests sent too fast: %s", elapsed)
+	}
+
+	client = &Client{Host: server.URL, RateLimit: &RateLimiter{Rate: 1}}
+	client.NewRequest("GET").Send()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start = time.Now()
+	if resp := client.NewRequest("GET").SendContext(ctx); resp.Error == nil || resp.Error.Type != RateLimited {
+		t.Errorf("FAIL(deadline): unexpected error: %v", resp.Error)
+	} else if elapsed := time.Since(start); elapsed > 25*time.Millisecond {
+		t.Errorf("FAIL(deadline): request waited: %s", elapsed)
+	}
+
+	s0, s1 := newEchoServer(), newEchoServer()
+	defer s0.Close()
+	defer s1.Close()
+
+	client = &Client{
+		Hosts:         []string{s0.URL, s1.URL},
+		HostRateLimit: &RateLimiter{Rate: 1, Reject: true},
+	}
+
+	for i := 0; i < 2; i++ {
+		if resp := client.NewRequest("GET").Send(); resp.Error != nil {
+			t.Errorf("FAIL(per-host): unexpected error: %s", resp.Error)
+		}
+	}
+
+	if resp := client.NewRequest("GET").Send(); resp.Error == nil || resp.Error.Type != RateLimited {
+		t.Errorf("FAIL(reject): unexpected error: %v", resp.Error)
+	}
+
+	// A rejection by the host limiter returns the token of the global one.
+	client = &Client{
+		Host:          s0.URL,
+		RateLimit:     &RateLimiter{Rate: 0.001, Burst: 2},
+		HostRateLimit: &RateLimiter{Rate: 0.001, Reject: true},
+	}
+
+	client.NewRequest("GET").Send()
+	if resp := client.NewRequest("GET").Send(); resp.Error == nil || resp.Error.Type != RateLimited {
+		t.Errorf("FAIL(refund): unexpected error: %v", resp.Error)
+	}
+	if delay := client.RateLimit.reserve("", time.Now()); delay > 0 {
+		t.Errorf("FAIL(refund): global token not returned: %s", delay)
+	}
+
+	// An open circuit fails fast without waiting for a token or a slot.
+	failing, _ := newFlakyServer(1, http.StatusInternalServerError, nil)
+	defer failing.Close()
+
+	client = &Client{
+		Host:      failing.URL,
+		Limit:     1,
+		RateLimit: &RateLimiter{Rate: 1},
+		Breaker:   &CircuitBreaker{MinRequests: 1},
+	}
+
+	client.NewRequest("GET").Send()
+
+	start = time.Now()
+	if resp := client.NewRequest("GET").Send(); resp.Error == nil || resp.Error.Type != CircuitOpen {
+		t.Errorf("FAIL(circuit): unexpected error: %v", resp.Error)
+	} else if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("FAIL(circuit): request waited: %s", elapsed)
+	}
+
+	throttled, _ := newFlakyServer(1, http.StatusTooManyRequests, http.Header{"Retry-After": []string{"1"}})
+	defer throttled.Close()
+
+	client = &Client{Host: throttled.URL, RateLimit: &RateLimiter{Rate: 1000, Reject: true}}
+
+	if resp := client.NewRequest("GET").Send(); resp.Code != http.StatusTooManyRequests {
+		t.Errorf("FAIL(slowdown): unexpected response: %d %v", resp.Code, resp.Error)
+	}
+
+	if resp := client.NewRequest("GET").Send(); resp.Error == nil || resp.Error.Type != RateLimited {
+		t.Errorf("FAIL(slowdown): unexpected error: %v", resp.Error)
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	limiter := &RateLimiter{Rate: 10}
+	now := time.Now()
+
+	limiter.reserve("a", now)
+	limiter.reserve("b", now)
+	limiter.record("b", &Response{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"3600"}}})
+
+	limiter.reserve("c", now.Add(2*time.Minute))
+
+	if _, ok := limiter.buckets["a"]; ok || len(limiter.buckets) != 2 {
+		t.Errorf("FAIL(sweep): unexpected buckets: %d", len(limiter.buckets))
+	}
+}
+
+type quotaError struct {
+	Quota int `json:"quota"`
+}
+
+func (err *quotaError) Error() string {
+	return "quota exceeded: " + strconv.Itoa(err.Quota)
+}
+
+var errGone = errors.New("gone")
+
+func TestClientErrorDecoding(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.Header().Set("X-Path", req.URL.Path)
+		switch req.URL.Path {
+		case "/quota":
+			writer.WriteHeader(http.StatusTooManyRequests)
+			writer.Write([]byte(`{"quota":10}`))
+		case "/gone":
+			http.Error(writer, "gone", http.StatusGone)
+		default:
+			http.Error(writer, "bad", http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	client := &Client{
+		Host: server.URL,
+		ErrorDecoders: []ErrorDecoder{
+			NewErrorDecoder((*quotaError)(nil), http.StatusTooManyRequests),
+			func(resp *Response) error {
+				if resp.Code == http.StatusGone {
+					return errGone
+				}
+				return nil
+			},
+		},
+	}
+
+	err := client.NewRequest("GET").SetPath("/bad").Send().GetBody(nil)
+
+	var statusErr *StatusError
+	if err == nil || err.Type != EndpointError || !errors.As(err, &statusErr) {
+		t.Fatalf("FAIL(status): unexpected error: %v", err)
+	}
+
+	if statusErr.Code != http.StatusBadRequest || statusErr.Header.Get("X-Path") != "/bad" || statusErr.Err != nil {
+		t.Errorf("FAIL(status): unexpected status error: %d %v %v", statusErr.Code, statusErr.Header, statusErr.Err)
+	}
+
+	err = client.NewRequest("GET").SetPath("/quota").Send().GetBody(nil)
+
+	var quotaErr *quotaError
+	if !errors.As(err, &quotaErr) || quotaErr.Quota != 10 {
+		t.Errorf("FAIL(as): unexpected error: %v", err)
+	}
+
+	if err = client.NewRequest("GET").SetPath("/gone").Send().GetBody(nil); !errors.Is(err, errGone) {
+		t.Errorf("FAIL(is): unexpected error: %v", err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("FAIL(nil): expected panic")
+			}
+		}()
+		NewErrorDecoder(nil)
+	}()
+}
+
+func TestResponseExpect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		code, _ := strconv.Atoi(req.URL.Path[1:])
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(code)
+		writer.Write([]byte(`{"code":` + strconv.Itoa(code) + `}`))
+	}))
+	defer server.Close()
+
+	client := &Client{Host: server.URL}
+
+	type body struct {
+		Code int `json:"code"`
+	}
+
+	send := func(code int) *Request {
+		return client.NewRequest("GET").SetPath("/%d", code)
+	}
+
+	var ok body
+	if err := send(202).Send().GetBody(&ok); err != nil || ok.Code != 202 {
+		t.Errorf("FAIL(2xx): unexpected result: %d %v", ok.Code, err)
+	}
+
+	if err := send(304).Send().GetBody(nil); err == nil || err.Type != UnexpectedStatusCode {
+		t.Errorf("FAIL(3xx): unexpected error: %v", err)
+	}
+
+	if err := send(201).Expect(200).Send().GetBody(nil); err == nil || err.Type != UnexpectedStatusCode {
+		t.Errorf("FAIL(unexpected): unexpected error: %v", err)
+	}
+
+	ok = body{}
+	resp := send(404).Expect(200, 404).Send()
+	if err := resp.GetBody(&ok); err != nil || resp.Code != 404 || ok.Code != 0 {
+		t.Errorf("FAIL(expected): unexpected result: %d %d %v", resp.Code, ok.Code, err)
+	}
+
+	if err := send(500).Expect(200, 404).Send().GetBody(nil); err == nil || err.Type != EndpointError {
+		t.Errorf("FAIL(error): unexpected error: %v", err)
+	}
+
+	var conflict body
+	ok = body{}
+	if err := send(409).ExpectBody(409, &conflict).Send().GetBody(&ok); err != nil || conflict.Code != 409 || ok.Code != 0 {
+		t.Errorf("FAIL(target): unexpected result: %d %d %v", conflict.Code, ok.Code, err)
+	}
+
+	conflict = body{}
+	if err := send(200).ExpectBody(409, &conflict).Send().GetBody(&ok); err != nil || conflict.Code != 0 || ok.Code != 200 {
+		t.Errorf("FAIL(target-2xx): unexpected result: %d %d %v", conflict.Code, ok.Code, err)
+	}
+
+	if err := send(201).ExpectBody(409, &conflict).Expect(200).Send().GetBody(&ok); err == nil || err.Type != UnexpectedStatusCode {
+		t.Errorf("FAIL(target-unexpected): unexpected error: %v", err)
+	}
+
+	ok = body{}
+	if err := send(204).Expect(204).Send().GetBody(&ok); err != nil || ok.Code != 0 {
+		t.Errorf("FAIL(empty): unexpected result: %d %v", ok.Code, err)
+	}
+
+	if err := send(204).ExpectBody(204, &conflict).Send().GetBody(&ok); err != nil {
+		t.Errorf("FAIL(empty-target): unexpected error: %v", err)
+	}
+}
+
+func TestClientStreaming(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/ndjson":
+			writer.Write([]byte("{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n"))
+		case "/array":
+			writer.Write([]byte(`[{"n":1}, {"n":2}, {"n":3}]`))
+		case "/sse":
+			writer.Write([]byte(": comment\nid: 1\nevent: update\ndata: {\"n\":1}\n\nevent: ping\n\ndata: {\"n\":\ndata: 2}\n\n"))
+		case "/block":
+			writer.Write([]byte("{\"n\":1}\n"))
+			writer.(http.Flusher).Flush()
+			<-req.Context().Done()
+		default:
+			http.Error(writer, "bad", http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	client := &Client{Host: server.URL}
+
+	type item struct {
+		N int `json:"n"`
+	}
+
+	stream := func(path string) *Response {
+		return client.NewRequest("GET").SetPath(path).SetStreaming(true).Send()
+	}
+
+	var sum int
+	if err := stream("/ndjson").ReadNDJSON(func(i item) { sum += i.N }); err != nil || sum != 6 {
+		t.Errorf("FAIL(ndjson): unexpected result: %d %v", sum, err)
+	}
+
+	items := make(chan item)
+	go func() {
+		if err := stream("/array").ReadJSONArray(items); err != nil {
+			t.Errorf("FAIL(array): unexpected error: %s", err)
+		}
+	}()
+
+	sum = 0
+	for i := range items {
+		sum += i.N
+	}
+
+	if sum != 6 {
+		t.Errorf("FAIL(array): unexpected sum: %d", sum)
+	}
+
+	var events []Event
+	if err := stream("/sse").ReadEvents(func(event Event) { events = append(events, event) }); err != nil || len(events) != 2 {
+		t.Errorf("FAIL(sse): unexpected result: %v %v", events, err)
+	} else if events[0].ID != "1" || events[0].Type != "update" || events[1].ID != "1" || events[1].Type != "" || events[1].Data != "{\"n\":\n2}" {
+		t.Errorf("FAIL(sse): unexpected events: %v", events)
+	}
+
+	sum = 0
+	if err := stream("/sse").ReadEvents(func(i item) { sum += i.N }); err != nil || sum != 3 {
+		t.Errorf("FAIL(sse-json): unexpected result: %d %v", sum, err)
+	}
+
+	stop := errors.New("stop")
+	if err := stream("/ndjson").ReadNDJSON(func(i item) error { return stop }); err == nil || err.Type != StreamError || !errors.Is(err, stop) {
+		t.Errorf("FAIL(stop): unexpected error: %v", err)
+	}
+
+	if err := stream("/bad").ReadNDJSON(func(i item) {}); err == nil || err.Type != EndpointError {
+		t.Errorf("FAIL(error): unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resp := client.NewRequest("GET").SetPath("/block").SetStreaming(true).SendContext(ctx)
+
+	err := resp.ReadNDJSON(func(i item) { cancel() })
+	if err == nil || err.Type != CanceledError {
+		t.Errorf("FAIL(cancel): unexpected error: %v", err)
+	}
+}
+
+func TestClientBodyReader(t *testing.T) {
+	count := new(int32)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/flaky" && atomic.AddInt32(count, 1) == 1 {
+			ioutil.ReadAll(req.Body)
+			http.Error(writer, "flaky", http.StatusServiceUnavailable)
+			return
+		}
+
+		var reader io.Reader = req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(req.Body)
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusBadRequest)
+				return
+			}
+			reader = gz
+		}
+
+		body, _ := ioutil.ReadAll(reader)
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(string(body))
+	}))
+	defer server.Close()
+
+	client := &Client{Host: server.URL, Retry: &RetryPolicy{MaxAttempts: 3, RetryNonIdempotent: true}}
+
+	var sent, total int64
+	progress := func(n, t int64) { sent, total = n, t }
+
+	var result string
+	resp := client.NewRequest("POST").
+		SetGzipLevel(gzip.BestSpeed).
+		SetBodyReader(strings.NewReader(`"hello"`)).
+		SetProgress(progress).
+		Send()
+
+	if err := resp.GetBody(&result); err != nil || result != `"hello"` {
+		t.Errorf("FAIL(gzip): unexpected result: %s %v", result, err)
+	}
+
+	if sent != 7 || total != 7 {
+		t.Errorf("FAIL(progress): unexpected progress: %d/%d", sent, total)
+	}
+
+	resp = client.NewRequest("POST").SetPath("/flaky").SetBodyReader(strings.NewReader(`"seek"`)).Send()
+	if err := resp.GetBody(&result); err != nil || result != `"seek"` || resp.Attempts != 2 {
+		t.Errorf("FAIL(replay): unexpected result: %s %d %v", result, resp.Attempts, err)
+	}
+
+	atomic.StoreInt32(count, 0)
+	resp = client.NewRequest("POST").SetPath("/flaky").SetBodyReader(io.MultiReader(strings.NewReader(`"once"`))).Send()
+	if resp.Code != http.StatusServiceUnavailable || resp.Attempts != 1 {
+		t.Errorf("FAIL(once): unexpected response: %d %d", resp.Code, resp.Attempts)
+	}
+
+	// The gzip level can be set after the body reader.
+	resp = client.NewRequest("POST").
+		SetBodyReader(strings.NewReader(`"late"`)).
+		SetGzipLevel(gzip.BestSpeed).
+		Send()
+
+	if err := resp.GetBody(&result); err != nil || result != `"late"` {
+		t.Errorf("FAIL(gzip-late): unexpected result: %s %v", result, err)
+	}
+}
+
+func TestClientBodyClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rest-body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.txt")
+	ioutil.WriteFile(path, []byte(strings.Repeat("x", 1<<16)), 0644)
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	before := runtime.NumGoroutine()
+
+	// The bodies are never consumed since the server is down so the
+	// goroutines streaming them must be stopped when the body is closed.
+	client := &Client{Host: server.URL}
+	for i := 0; i < 10; i++ {
+		client.NewRequest("POST").
+			SetGzipLevel(gzip.BestSpeed).
+			SetMultipart(NewMultipart().AddFilePath("file", path)).
+			SetProgress(func(n, t int64) {}).
+			Send()
+	}
+
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before; {
+		if time.Now().After(deadline) {
+			t.Errorf("FAIL(leak): unexpected goroutines: %d > %d", runtime.NumGoroutine(), before)
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClientMultipart(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if err := req.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result := map[string]string{}
+		for name, values := range req.MultipartForm.Value {
+			result[name] = values[0]
+		}
+
+		for name, files := range req.MultipartForm.File {
+			file, _ := files[0].Open()
+			data, _ := ioutil.ReadAll(file)
+			file.Close()
+			result[name] = files[0].Filename + ":" + string(data)
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(result)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "rest-multipart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.txt")
+	ioutil.WriteFile(path, []byte("from path"), 0644)
+
+	body := NewMultipart().
+		AddField("field", "value").
+		AddJSON("json", map[string]int{"a": 1}).
+		AddFilePath("path", path).
+		AddFile("reader", "b.txt", strings.NewReader("from reader"))
+
+	var uploaded int64
+	client := &Client{Host: server.URL}
+
+	var result map[string]string
+	resp := client.NewRequest("POST").SetMultipart(body).SetProgress(func(n, t int64) { uploaded = n }).Send()
+	if err := resp.GetBody(&result); err != nil {
+		t.Fatalf("FAIL(multipart): unexpected error: %s", err)
+	}
+
+	if result["field"] != "value" || result["json"] != `{"a":1}` || result["path"] != "a.txt:from path" || result["reader"] != "b.txt:from reader" {
+		t.Errorf("FAIL(multipart): unexpected result: %v", result)
+	}
+
+	if uploaded == 0 {
+		t.Errorf("FAIL(progress): no progress reported")
+	}
+}
+
+func TestClientETags(t *testing.T) {
+	var mutex sync.Mutex
+	value, conditional := "a", 0
+
+	mux := &Mux{}
+	mux.AddRoute(&Route{Path: NewPath("/value"), Method: "GET", Handler: func() string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return value
+	}})
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if len(req.Header.Get("If-None-Match")) > 0 {
+			mutex.Lock()
+			conditional++
+			mutex.Unlock()
+		}
+		mux.ServeHTTP(writer, req)
+	}))
+	defer server.Close()
+
+	client := &Client{Host: server.URL, ETags: &ETagCache{}}
+
+	check := func(title, exp string, expNotModified bool) *Response {
+		var result string
+		resp := client.NewRequest("GET").SetPath("/value").Send()
+		if err := resp.GetBody(&result); err != nil {
+			t.Errorf("FAIL(%s): unexpected error: %s", title, err)
+		} else if result != exp {
+			t.Errorf("FAIL(%s): unexpected result: %s != %s", title, result, exp)
+		}
+
+		if resp.NotModified != expNotModified {
+			t.Errorf("FAIL(%s): unexpected not modified: %v", title, resp.NotModified)
+		}
+		return resp
+	}
+
+	// Mutating a response doesn't affect the cached response.
+	first := check("first", "a", false)
+	first.Header.Set("X-Mutated", "true")
+	first.Body[1] = 'z'
+
+	if resp := check("not-modified", "a", true); len(resp.Header.Get("X-Mutated")) > 0 {
+		t.Errorf("FAIL(not-modified): unexpected mutated header")
+	}
+
+	mutex.Lock()
+	value = "b"
+	mutex.Unlock()
+
+	check("modified", "b", false)
+	check("not-modified-again", "b", true)
+
+	// Clients sharing the cache don't share their responses.
+	client = &Client{Host: server.URL, ETags: client.ETags}
+	check("other-client", "b", false)
+
+	if conditional != 3 {
+		t.Errorf("FAIL(conditional): unexpected conditional requests: %d != 3", conditional)
+	}
+
+	if client.ETags.Len() != 2 {
+		t.Errorf("FAIL(len): unexpected cached responses: %d != 2", client.ETags.Len())
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials authenticate the requests sent by a Client. Authorize is called
+// for every attempt of a request, after the headers of the request were set,
+// and must be safe to call concurrently.
+type Credentials interface {
+
+	// Authorize adds the credentials to the HTTP request of an attempt of the
+	// given request.
+	Authorize(req *Request, httpReq *http.Request) error
+}
+
+// Refresher is implemented by the Credentials which can be renewed. When a
+// request is rejected with a 401 status code, Refresh is called with the
+// rejected HTTP request and the request is sent again once.
+type Refresher interface {
+
+	// Refresh discards the cached credentials if they were used by the given
+	// HTTP request such that new credentials are obtained for the next
+	// request. Credentials renewed since the request was sent are kept.
+	Refresh(httpReq *http.Request)
+}
+
+// BearerToken is a static bearer token sent in the Authorization header.
+type BearerToken string
+
+// Authorize sets the Authorization header of the request.
+func (token BearerToken) Authorize(req *Request, httpReq *http.Request) error {
+	httpReq.Header.Set("Authorization", "Bearer "+string(token))
+	return nil
+}
+
+// BasicAuth are the credentials of the HTTP basic authentication scheme.
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+// Authorize sets the Authorization header of the request.
+func (auth *BasicAuth) Authorize(req *Request, httpReq *http.Request) error {
+	httpReq.SetBasicAuth(auth.Username, auth.Password)
+	return nil
+}
+
+// DefaultTokenExpiryDelta is the default delay before the expiry of a token at
+// which it's considered expired.
+const DefaultTokenExpiryDelta = 10 * time.Second
+
+// DefaultTokenTimeout is the default timeout of the requests to a token
+// endpoint.
+const DefaultTokenTimeout = 30 * time.Second
+
+// ClientCredentials obtains bearer tokens from an OAuth2 token endpoint using
+// the client credentials grant. Tokens are cached until they expire or until
+// the remote host rejects them.
+type ClientCredentials struct {
+
+	// TokenURL is the URL of the token endpoint.
+	TokenURL string
+
+	// ClientID and ClientSecret authenticate the client with the token
+	// endpoint.
+	ClientID     string
+	ClientSecret string
+
+	// Scopes is the list of scopes requested for the tokens.
+	Scopes []string
+
+	// Client is used to request the tokens. Defaults to http.DefaultClient.
+	Client *http.Client
+
+	// ExpiryDelta is the delay before the expiry of a token at which a new
+	// token is requested. Defaults to DefaultTokenExpiryDelta and is capped
+	// to half the lifetime of the token.
+	ExpiryDelta time.Duration
+
+	// Timeout bounds the requests to the token endpoint. Defaults to
+	// DefaultTokenTimeout.
+	Timeout time.Duration
+
+	mutex   sync.Mutex
+	token   string
+	expires time.Time
+	fetch   *tokenFetch
+}
+
+// tokenFetch is a token request shared by the concurrent callers of Token.
+type tokenFetch struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// Authorize sets the Authorization header of the request with a cached token
+// or with a new token if the cached token expired.
+func (creds *ClientCredentials) Authorize(req *Request, httpReq *http.Request) error {
+	token, err := creds.Token(httpReq)
+	if err != nil {
+		return err
+	}
+
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// Refresh discards the cached token if it was sent by the given request such
+// that concurrent rejections only renew the token once.
+func (creds *ClientCredentials) Refresh(httpReq *http.Request) {
+	creds.mutex.Lock()
+	defer creds.mutex.Unlock()
+
+	if httpReq.Header.Get("Authorization") == "Bearer "+creds.token {
+		creds.token = ""
+	}
+}
+
+// Token returns the cached token or requests a new one if the cached token
+// expired. Concurrent callers wait for a single token request which isn't
+// bound to their context such that a canceled caller doesn't fail the others.
+// Callers stop waiting once the context of their request is done.
+func (creds *ClientCredentials) Token(httpReq *http.Request) (string, error) {
+	creds.mutex.Lock()
+
+	if len(creds.token) > 0 && (creds.expires.IsZero() || time.Now().Before(creds.expires)) {
+		token := creds.token
+		creds.mutex.Unlock()
+		return token, nil
+	}
+
+	fetch := creds.fetch
+	if fetch == nil {
+		fetch = &tokenFetch{done: make(chan struct{})}
+		creds.fetch = fetch
+		go creds.refresh(fetch)
+	}
+
+	creds.mutex.Unlock()
+
+	select {
+	case <-fetch.done:
+		return fetch.token, fetch.err
+	case <-httpReq.Context().Done():
+		return "", httpReq.Context().Err()
+	}
+}
+
+func (creds *ClientCredentials) timeout() time.Duration {
+	if creds.Timeout > 0 {
+		return creds.Timeout
+	}
+	return DefaultTokenTimeout
+}
+
+// refresh requests a new token and hands it to the callers waiting on fetch.
+func (creds *ClientCredentials) refresh(fetch *tokenFetch) {
+	ctx, cancel := context.WithTimeout(context.Background(), creds.timeout())
+	defer cancel()
+
+	token, expires, err := creds.request(ctx)
+
+	creds.mutex.Lock()
+	if err == nil {
+		creds.token, creds.expires = token, expires
+	}
+	creds.fetch = nil
+	creds.mutex.Unlock()
+
+	fetch.token, fetch.err = token, err
+	close(fetch.done)
+}
+
+// request obtains a new token from the token endpoint along with the time at
+// which it expires. Tokens without an expiry have a zero expiry time.
+func (creds *ClientCredentials) request(ctx context.Context) (string, time.Time, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(creds.Scopes) > 0 {
+		form.Set("scope", strings.Join(creds.Scopes, " "))
+	}
+
+	tokenReq, err := http.NewRequestWithContext(ctx, "POST", creds.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tokenReq.SetBasicAuth(url.QueryEscape(creds.ClientID), url.QueryEscape(creds.ClientSecret))
+
+	client := creds.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	tokenResp, err := client.Do(tokenReq)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer tokenResp.Body.Close()
+
+	body, err := ioutil.ReadAll(tokenResp.Body)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if tokenResp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("token request failed with status %d: %s", tokenResp.StatusCode, body)
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", time.Time{}, err
+	}
+
+	if len(result.AccessToken) == 0 {
+		return "", time.Time{}, errors.New("token response has no access token")
+	}
+
+	if len(result.TokenType) > 0 && !strings.EqualFold(result.TokenType, "bearer") {
+		return "", time.Time{}, fmt.Errorf("unsupported token type: '%s'", result.TokenType)
+	}
+
+	delta := creds.ExpiryDelta
+	if delta == 0 {
+		delta = DefaultTokenExpiryDelta
+	}
+
+	// Tokens without an expiry are kept until they're rejected.
+	if result.ExpiresIn <= 0 {
+		return result.AccessToken, time.Time{}, nil
+	}
+
+	lifetime := time.Duration(result.ExpiresIn) * time.Second
+	if delta > lifetime/2 {
+		delta = lifetime / 2
+	}
+
+	return result.AccessToken, time.Now().Add(lifetime - delta), nil
+}
+
+// HMACScheme is the scheme of the Authorization header of requests signed by
+// HMACSigner.
+const HMACScheme = "HMAC-SHA256"
+
+// TimestampHeader is the header holding the unix timestamp, in seconds, at
+// which a request was signed by HMACSigner.
+const TimestampHeader = "X-Timestamp"
+
+// HMACSigner signs requests with a shared secret. The Authorization header is
+// set to "HMAC-SHA256 <KeyID>:<signature>" where the signature is computed by
+// Signature over the method, path, timestamp and body of the request. Requests
+// with a streamed body can't be signed.
+type HMACSigner struct {
+
+	// KeyID identifies the secret to the remote host.
+	KeyID string
+
+	// Secret is the shared secret.
+	Secret []byte
+}
+
+// Authorize signs the request.
+func (signer *HMACSigner) Authorize(req *Request, httpReq *http.Request) error {
+	if req.body != nil {
+		return errors.New("can't sign a streamed request body")
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := Signature(signer.Secret, httpReq.Method, httpReq.URL.RequestURI(), timestamp, req.Body)
+
+	httpReq.Header.Set(TimestampHeader, timestamp)
+	httpReq.Header.Set("Authorization", HMACScheme+" "+signer.KeyID+":"+signature)
+	return nil
+}
+
+// Signature returns the hex encoded HMAC-SHA256 of the given request fields
+// using the given secret. The signed message is the method, the request URI
+// (path and query), the timestamp and the hex encoded SHA256 of the body, each
+// separated by a newline.
+func Signature(secret []byte, method, uri, timestamp string, body []byte) string {
+	hash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n" + hex.EncodeToString(hash[:])))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
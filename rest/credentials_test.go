@@ -0,0 +1,242 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest_test
+
+import (
+	"github.com/datacratic/gorest/rest"
+	"github.com/datacratic/gorest/rest/resttest"
+
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newAuthServer returns a server which responds with the Authorization header
+// of the requests accepted by the given check.
+func newAuthServer(check func(*http.Request, []byte) bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if !check(req, body) {
+			http.Error(writer, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write([]byte(`"` + req.Header.Get("Authorization") + `"`))
+	}))
+}
+
+func TestClientStaticCredentials(t *testing.T) {
+	server := newAuthServer(func(req *http.Request, body []byte) bool { return true })
+	defer server.Close()
+
+	var result string
+
+	client := &rest.Client{Host: server.URL, Auth: rest.BearerToken("abc")}
+	if err := client.NewRequest("GET").Send().GetBody(&result); err != nil || result != "Bearer abc" {
+		t.Errorf("FAIL(bearer): unexpected result: %s %v", result, err)
+	}
+
+	client = &rest.Client{Host: server.URL, Auth: &rest.BasicAuth{Username: "user", Password: "pass"}}
+	if err := client.NewRequest("GET").Send().GetBody(&result); err != nil || result != "Basic dXNlcjpwYXNz" {
+		t.Errorf("FAIL(basic): unexpected result: %s %v", result, err)
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	tokens := resttest.NewTokenServer("id", "secret")
+	defer tokens.Close()
+
+	server := newAuthServer(func(req *http.Request, body []byte) bool {
+		return tokens.Valid(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+	})
+	defer server.Close()
+
+	client := &rest.Client{
+		Host: server.URL,
+		Auth: &rest.ClientCredentials{TokenURL: tokens.TokenURL(), ClientID: "id", ClientSecret: "secret"},
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := client.NewRequest("GET").Send().GetBody(nil); err != nil {
+			t.Errorf("FAIL(cached): unexpected error: %s", err)
+		}
+	}
+
+	if n := tokens.Issued(); n != 1 {
+		t.Errorf("FAIL(cached): unexpected number of tokens: %d", n)
+	}
+
+	tokens.Revoke()
+
+	if err := client.NewRequest("GET").Send().GetBody(nil); err != nil {
+		t.Errorf("FAIL(refresh): unexpected error: %s", err)
+	}
+
+	if n := tokens.Issued(); n != 2 {
+		t.Errorf("FAIL(refresh): unexpected number of tokens: %d", n)
+	}
+
+	client = &rest.Client{
+		Host: server.URL,
+		Auth: &rest.ClientCredentials{TokenURL: tokens.TokenURL(), ClientID: "id", ClientSecret: "wrong"},
+	}
+
+	if resp := client.NewRequest("GET").Send(); resp.Error == nil || resp.Error.Type != rest.CredentialsError {
+		t.Errorf("FAIL(invalid): unexpected error: %v", resp.Error)
+	}
+}
+
+func TestClientCredentialsRefresh(t *testing.T) {
+	tokens := resttest.NewTokenServer("id", "secret")
+	defer tokens.Close()
+
+	// The first rejections are held until they all happened such that they
+	// all refresh the same token.
+	const n = 8
+	var rejected sync.WaitGroup
+	rejected.Add(n)
+	rejections := int32(0)
+
+	server := newAuthServer(func(req *http.Request, body []byte) bool {
+		if tokens.Valid(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")) {
+			return true
+		}
+		if atomic.AddInt32(&rejections, 1) <= n {
+			rejected.Done()
+			rejected.Wait()
+		}
+		return false
+	})
+	defer server.Close()
+
+	client := &rest.Client{
+		Host: server.URL,
+		Auth: &rest.ClientCredentials{TokenURL: tokens.TokenURL(), ClientID: "id", ClientSecret: "secret"},
+	}
+
+	if err := client.NewRequest("GET").Send().GetBody(nil); err != nil {
+		t.Fatalf("FAIL(first): unexpected error: %s", err)
+	}
+
+	tokens.Revoke()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := client.NewRequest("GET").Send().GetBody(nil); err != nil {
+				t.Errorf("FAIL(concurrent): unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if issued := tokens.Issued(); issued != 2 {
+		t.Errorf("FAIL(concurrent): unexpected number of tokens: %d", issued)
+	}
+
+	// Tokens whose lifetime is shorter than the expiry delta are still cached.
+	short := resttest.NewTokenServer("id", "secret")
+	short.TTL = 2 * time.Second
+	defer short.Close()
+
+	open := newAuthServer(func(req *http.Request, body []byte) bool { return true })
+	defer open.Close()
+
+	client = &rest.Client{
+		Host: open.URL,
+		Auth: &rest.ClientCredentials{TokenURL: short.TokenURL(), ClientID: "id", ClientSecret: "secret"},
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := client.NewRequest("GET").Send().GetBody(nil); err != nil {
+			t.Errorf("FAIL(short): unexpected error: %s", err)
+		}
+	}
+
+	if issued := short.Issued(); issued != 1 {
+		t.Errorf("FAIL(short): unexpected number of tokens: %d", issued)
+	}
+}
+
+func TestClientCredentialsCanceled(t *testing.T) {
+	tokens := resttest.NewTokenServer("id", "secret")
+	defer tokens.Close()
+
+	// The token endpoint is held until the first caller gave up.
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		<-release
+		httpReq, _ := http.NewRequest(req.Method, tokens.TokenURL(), req.Body)
+		httpReq.Header = req.Header
+
+		resp, err := http.DefaultClient.Do(httpReq)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		writer.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		writer.WriteHeader(resp.StatusCode)
+		io.Copy(writer, resp.Body)
+	}))
+	defer slow.Close()
+
+	creds := &rest.ClientCredentials{TokenURL: slow.URL, ClientID: "id", ClientSecret: "secret"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled, _ := http.NewRequestWithContext(ctx, "GET", "/", nil)
+	go cancel()
+
+	if _, err := creds.Token(canceled); err != context.Canceled {
+		t.Errorf("FAIL(canceled): unexpected error: %v", err)
+	}
+
+	close(release)
+
+	httpReq, _ := http.NewRequest("GET", "/", nil)
+	if token, err := creds.Token(httpReq); err != nil || !tokens.Valid(token) {
+		t.Errorf("FAIL(shared): unexpected token: '%s' %v", token, err)
+	}
+
+	if issued := tokens.Issued(); issued != 1 {
+		t.Errorf("FAIL(shared): unexpected number of tokens: %d", issued)
+	}
+}
+
+func TestClientHMACSigner(t *testing.T) {
+	secret := []byte("secret")
+
+	server := newAuthServer(func(req *http.Request, body []byte) bool {
+		timestamp := req.Header.Get(rest.TimestampHeader)
+		signature := rest.Signature(secret, req.Method, req.URL.RequestURI(), timestamp, body)
+		return req.Header.Get("Authorization") == rest.HMACScheme+" key:"+signature
+	})
+	defer server.Close()
+
+	client := &rest.Client{Host: server.URL, Auth: &rest.HMACSigner{KeyID: "key", Secret: secret}}
+
+	if err := client.NewRequest("POST").SetPath("/sign").AddParam("a", "b").SetBody("body").Send().GetBody(nil); err != nil {
+		t.Errorf("FAIL(sign): unexpected error: %s", err)
+	}
+
+	client.Auth = &rest.HMACSigner{KeyID: "key", Secret: []byte("wrong")}
+	if err := client.NewRequest("POST").SetBody("body").Send().GetBody(nil); err == nil || err.Type != rest.EndpointError {
+		t.Errorf("FAIL(wrong): unexpected error: %v", err)
+	}
+
+	resp := client.NewRequest("POST").SetBodyReader(strings.NewReader(`"body"`)).Send()
+	if resp.Error == nil || resp.Error.Type != rest.CredentialsError {
+		t.Errorf("FAIL(stream): unexpected error: %v", resp.Error)
+	}
+}
@@ -3,7 +3,11 @@
 package rest
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
+	"net/http"
+	"reflect"
 )
 
 // ErrorType is used to categories errors reported into types.
@@ -39,10 +43,45 @@ const (
 	// request.
 	SendRequestError = "send-request-error"
 
+	// NoHostsError indicates that the resolver of a client didn't supply any
+	// hosts to send a request to.
+	NoHostsError = "no-hosts-error"
+
+	// CircuitOpen indicates that a request was rejected because the circuit
+	// breaker of its host was open.
+	CircuitOpen = "circuit-open"
+
+	// LimitExceeded indicates that a request was rejected because the limit
+	// of concurrent requests of its client was reached for too long or too
+	// many requests were already waiting.
+	LimitExceeded = "limit-exceeded"
+
+	// RateLimited indicates that a request was rejected because sending it
+	// would exceed the rate limit of its client.
+	RateLimited = "rate-limited"
+
+	// StreamError indicates that a streamed response could not be consumed.
+	StreamError = "stream-error"
+
+	// BatchError indicates that a batch of requests failed as a whole.
+	BatchError = "batch-error"
+
+	// CredentialsError indicates that the credentials of a client could not
+	// be added to a request.
+	CredentialsError = "credentials-error"
+
 	// TimeoutError indicates that the request timed out while sending an HTTP
 	// request.
 	TimeoutError = "timeout-error"
 
+	// DeadlineError indicates that the deadline of the context associated with
+	// a request expired before the request completed.
+	DeadlineError = "deadline-error"
+
+	// CanceledError indicates that the context associated with a request was
+	// canceled before the request completed.
+	CanceledError = "canceled-error"
+
 	// UnmarshalError indicates that an error occured while deserializing the
 	// body of an HTTP response.
 	UnmarshalError = "unmarshal-error"
@@ -54,6 +93,45 @@ const (
 	// MarshalError indicates that an error occured while serializing the body
 	// of an HTTP request.
 	MarshalError = "marshal-error"
+
+	// Unauthorized indicates that a request was rejected because its
+	// credentials were missing or invalid.
+	Unauthorized = "unauthorized"
+
+	// Forbidden indicates that a request was rejected because its caller
+	// isn't allowed to invoke the route.
+	Forbidden = "forbidden"
+
+	// PreconditionFailed indicates that a request was rejected because its
+	// If-Match header didn't match the current version of the resource.
+	PreconditionFailed = "precondition-failed"
+
+	// PreconditionRequired indicates that a request was rejected because it
+	// didn't have an If-Match header.
+	PreconditionRequired = "precondition-required"
+
+	// TooManyRequests indicates that a request was rejected because its
+	// caller exceeded the rate limit of a Throttle.
+	TooManyRequests = "too-many-requests"
+
+	// Overloaded indicates that a request was rejected because a Throttle
+	// reached its maximum number of requests in flight.
+	Overloaded = "overloaded"
+
+	// IdempotencyConflict indicates that a request was rejected because a
+	// request with the same idempotency key is still in progress.
+	IdempotencyConflict = "idempotency-conflict"
+
+	// IdempotencyMismatch indicates that a request was rejected because its
+	// idempotency key was used by a request with a different body.
+	IdempotencyMismatch = "idempotency-mismatch"
+
+	// IdempotencyError indicates that the IdempotencyStore of a mux failed.
+	IdempotencyError = "idempotency-error"
+
+	// DocumentationError indicates that the documentation page could not be
+	// served.
+	DocumentationError = "documentation-error"
 )
 
 // Error is a typed wrapper for an error that occured while processing a REST
@@ -79,6 +157,95 @@ func (err *Error) Error() string {
 	return fmt.Sprintf("REST error(%s): %s", err.Type, err.Sub.Error())
 }
 
+// Unwrap returns the wrapped error such that errors.Is and errors.As can be
+// used to inspect the error.
+func (err *Error) Unwrap() error {
+	return err.Sub
+}
+
+// StatusError is the error wrapped in the Error returned by Response.GetBody
+// when the remote endpoint responds with an error status code.
+type StatusError struct {
+
+	// Code is the HTTP status code of the response.
+	Code int
+
+	// Header holds the headers of the response.
+	Header http.Header
+
+	// Body is the raw body of the response.
+	Body []byte
+
+	// Err is the error decoded from the response by one of the ErrorDecoders
+	// of the client. Nil if the response wasn't decoded.
+	Err error
+}
+
+// Error returns the decoded error or the body of the response.
+func (err *StatusError) Error() string {
+	if err.Err != nil {
+		return err.Err.Error()
+	}
+	return string(err.Body)
+}
+
+// Unwrap returns the decoded error.
+func (err *StatusError) Unwrap() error {
+	return err.Err
+}
+
+// ErrorDecoder converts the response of a remote endpoint with an error status
+// code into a custom error. Returns nil if the response can't be decoded by
+// this decoder.
+type ErrorDecoder func(resp *Response) error
+
+// NewErrorDecoder returns an ErrorDecoder which unmarshals the JSON body of
+// the responses with one of the given status codes into a new value of the
+// type of the given error. If no codes are given then all error status codes
+// are decoded. The given error is only used for its type which is typically a
+// pointer to a struct and which must not be a nil interface:
+//
+//	client.ErrorDecoders = append(client.ErrorDecoders,
+//	    rest.NewErrorDecoder((*QuotaError)(nil), http.StatusTooManyRequests))
+func NewErrorDecoder(proto error, codes ...int) ErrorDecoder {
+	if proto == nil {
+		log.Panic("nil error prototype for error decoder: use a typed nil such as (*MyError)(nil)")
+	}
+
+	typ := reflect.TypeOf(proto)
+
+	elem := typ
+	if typ.Kind() == reflect.Ptr {
+		elem = typ.Elem()
+	}
+
+	return func(resp *Response) error {
+		if len(codes) > 0 && !containsCode(codes, resp.Code) {
+			return nil
+		}
+
+		value := reflect.New(elem)
+		if err := json.Unmarshal(resp.Body, value.Interface()); err != nil {
+			return nil
+		}
+
+		if typ.Kind() != reflect.Ptr {
+			value = value.Elem()
+		}
+
+		return value.Interface().(error)
+	}
+}
+
+func containsCode(codes []int, code int) bool {
+	for _, other := range codes {
+		if other == code {
+			return true
+		}
+	}
+	return false
+}
+
 // CodedError is used to control the HTTP return code of a REST request when an
 // error occurs.
 //
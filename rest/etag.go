@@ -0,0 +1,130 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// DefaultETagEntries is the default maximum number of responses kept by an
+// ETagCache.
+const DefaultETagEntries = 1024
+
+// ETagCache keeps the last response of the GET requests of a client which
+// carried an ETag. Subsequent requests to the same URL are sent with an
+// If-None-Match header and a 304 response is transparently replaced by the
+// cached response. Responses are cached separately for each Client since the
+// credentials of Client.Auth are added once the request is intercepted: a
+// Client whose Auth is replaced should be given a new cache.
+type ETagCache struct {
+
+	// MaxEntries is the maximum number of cached responses. Defaults to
+	// DefaultETagEntries.
+	MaxEntries int
+
+	mutex   sync.Mutex
+	entries map[string]*etagEntry
+}
+
+type etagEntry struct {
+	etag   string
+	header http.Header
+	body   []byte
+}
+
+func (cache *ETagCache) maxEntries() int {
+	if cache.MaxEntries > 0 {
+		return cache.MaxEntries
+	}
+	return DefaultETagEntries
+}
+
+// key returns the key of the cached response of the request. Requests of
+// different clients or carrying their own credentials are cached separately.
+func (cache *ETagCache) key(req *Request) string {
+	key := fmt.Sprintf("%p ", req.REST) + req.Host + req.Path
+	if req.Query != nil {
+		key += "?" + req.Query.Encode()
+	}
+	if auth := req.Header.Get("Authorization"); len(auth) > 0 {
+		key += " " + auth
+	}
+	return key
+}
+
+func (cache *ETagCache) get(key string) *etagEntry {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return cache.entries[key]
+}
+
+func (cache *ETagCache) put(key string, entry *etagEntry) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cache.entries == nil {
+		cache.entries = make(map[string]*etagEntry)
+	}
+
+	if _, ok := cache.entries[key]; !ok {
+		for other := range cache.entries {
+			if len(cache.entries) < cache.maxEntries() {
+				break
+			}
+			delete(cache.entries, other)
+		}
+	}
+
+	cache.entries[key] = entry
+}
+
+// Len returns the number of cached responses.
+func (cache *ETagCache) Len() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return len(cache.entries)
+}
+
+// Intercept is an Interceptor which sends GET requests conditionally and
+// replaces 304 responses by the cached response. The response then has its
+// NotModified field set.
+func (cache *ETagCache) Intercept(ctx context.Context, req *Request, next Sender) *Response {
+	if req.Method != "GET" || req.Streaming || len(req.Header.Get("If-None-Match")) > 0 {
+		return next(ctx, req)
+	}
+
+	key := cache.key(req)
+	entry := cache.get(key)
+
+	if entry != nil {
+		req.Header.Set("If-None-Match", entry.etag)
+		defer req.Header.Del("If-None-Match")
+	}
+
+	resp := next(ctx, req)
+	if resp.Error != nil {
+		return resp
+	}
+
+	if resp.Code == http.StatusNotModified && entry != nil {
+		header := entry.header.Clone()
+		for name, values := range resp.Header {
+			header[name] = values
+		}
+
+		resp.Code = http.StatusOK
+		resp.Header = header
+		resp.Body = append([]byte(nil), entry.body...)
+		resp.NotModified = true
+
+	} else if etag := resp.Header.Get("ETag"); resp.Code == http.StatusOK && len(etag) > 0 {
+		cache.put(key, &etagEntry{etag, resp.Header.Clone(), append([]byte(nil), resp.Body...)})
+	}
+
+	return resp
+}
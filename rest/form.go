@@ -0,0 +1,143 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"reflect"
+	"strings"
+)
+
+// DefaultMaxMemory is the default number of bytes of a multipart request body
+// kept in memory before the remaining parts are stored in temporary files.
+const DefaultMaxMemory = 32 << 20
+
+var (
+	fileHeaderType  = reflect.TypeOf((*multipart.FileHeader)(nil))
+	fileHeadersType = reflect.TypeOf([]*multipart.FileHeader(nil))
+	readerType      = reflect.TypeOf((*io.Reader)(nil)).Elem()
+)
+
+// isForm indicates whether the given body type is bound to the parts of a
+// multipart/form-data request, which is the case for structs, or pointers to
+// structs, with at least one field tagged with `part:"name"`.
+func isForm(typ reflect.Type) bool {
+	if typ == nil {
+		return false
+	}
+
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	if typ.Kind() != reflect.Struct {
+		return false
+	}
+
+	for i := 0; i < typ.NumField(); i++ {
+		if _, ok := typ.Field(i).Tag.Lookup("part"); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// bindForm fills the tagged fields of the given struct from the parts of the
+// form. Fields are bound according to their type:
+//
+//   - *multipart.FileHeader and []*multipart.FileHeader receive the headers of
+//     the file parts which can be opened to read their content.
+//   - io.Reader receives the content of the first part which is closed once the
+//     handler returns.
+//   - string receives the content of the first part as is.
+//   - all other types are unmarshalled from the JSON content of the first part.
+//
+// Missing parts leave their field untouched. Opened files are appended to
+// closers.
+func bindForm(form *multipart.Form, value reflect.Value, closers *[]io.Closer) error {
+	if value.Kind() == reflect.Ptr {
+		value.Set(reflect.New(value.Type().Elem()))
+		value = value.Elem()
+	}
+
+	typ := value.Type()
+
+	for i := 0; i < typ.NumField(); i++ {
+		name, ok := typ.Field(i).Tag.Lookup("part")
+		if !ok {
+			continue
+		}
+
+		if err := bindPart(form, name, value.Field(i), closers); err != nil {
+			return fmt.Errorf("invalid part '%s': %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+func bindPart(form *multipart.Form, name string, field reflect.Value, closers *[]io.Closer) error {
+	files, values := form.File[name], form.Value[name]
+	if len(files) == 0 && len(values) == 0 {
+		return nil
+	}
+
+	switch field.Type() {
+
+	case fileHeaderType:
+		if len(files) == 0 {
+			return fmt.Errorf("expected file part")
+		}
+		field.Set(reflect.ValueOf(files[0]))
+		return nil
+
+	case fileHeadersType:
+		field.Set(reflect.ValueOf(files))
+		return nil
+
+	case readerType:
+		if len(files) == 0 {
+			field.Set(reflect.ValueOf(strings.NewReader(values[0])))
+			return nil
+		}
+
+		file, err := files[0].Open()
+		if err != nil {
+			return err
+		}
+
+		*closers = append(*closers, file)
+		field.Set(reflect.ValueOf(file))
+		return nil
+	}
+
+	var data []byte
+
+	if len(files) == 0 {
+		data = []byte(values[0])
+
+	} else {
+		file, err := files[0].Open()
+		if err != nil {
+			return err
+		}
+
+		data, err = ioutil.ReadAll(file)
+		file.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if field.Kind() == reflect.String {
+		field.SetString(string(data))
+		return nil
+	}
+
+	return json.Unmarshal(data, field.Addr().Interface())
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// latencySamples is the number of recent latencies kept by a client to
+	// compute the hedging delay.
+	latencySamples = 1024
+
+	// latencyRefresh is the number of new samples after which the cached
+	// percentiles are recomputed.
+	latencyRefresh = 64
+)
+
+// HedgePolicy controls the hedging of idempotent requests. If an attempt
+// hasn't completed after a delay then a duplicate request is sent, preferably
+// to another host. The first successful response is kept and the other
+// requests are canceled.
+type HedgePolicy struct {
+
+	// Delay is the delay after which a hedged request is sent. If not set
+	// then the delay is the Percentile of the latencies of the recent
+	// successful requests of the client.
+	Delay time.Duration
+
+	// Percentile is the percentile, between 0 and 100, of the recent
+	// latencies used as the delay if Delay is not set. Defaults to 95.
+	Percentile float64
+
+	// MinSamples is the minimum number of latencies to observe before the
+	// Percentile is used. Requests are not hedged until then. Defaults to 20.
+	MinSamples int
+
+	// MaxHedges is the maximum number of hedged requests sent in addition to
+	// the original request. Defaults to 1.
+	MaxHedges int
+}
+
+func (policy *HedgePolicy) delay(client *Client) (time.Duration, bool) {
+	if policy.Delay > 0 {
+		return policy.Delay, true
+	}
+
+	if client == nil {
+		return 0, false
+	}
+
+	percentile := policy.Percentile
+	if percentile <= 0 {
+		percentile = 95
+	}
+
+	minSamples := policy.MinSamples
+	if minSamples <= 0 {
+		minSamples = 20
+	}
+
+	return client.latencies.percentile(percentile, minSamples)
+}
+
+func (policy *HedgePolicy) maxHedges() int {
+	if policy.MaxHedges > 0 {
+		return policy.MaxHedges
+	}
+	return 1
+}
+
+// latencyTracker keeps a ring buffer of recent latencies.
+type latencyTracker struct {
+	mutex   sync.Mutex
+	samples []time.Duration
+	next    int
+	dirty   int
+	sorted  []time.Duration
+}
+
+func (tracker *latencyTracker) record(latency time.Duration) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if len(tracker.samples) < latencySamples {
+		tracker.samples = append(tracker.samples, latency)
+	} else {
+		tracker.samples[tracker.next] = latency
+		tracker.next = (tracker.next + 1) % latencySamples
+	}
+
+	tracker.dirty++
+}
+
+func (tracker *latencyTracker) percentile(p float64, minSamples int) (time.Duration, bool) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if len(tracker.samples) < minSamples || len(tracker.samples) == 0 {
+		return 0, false
+	}
+
+	if tracker.sorted == nil || tracker.dirty >= latencyRefresh {
+		tracker.sorted = append(tracker.sorted[:0], tracker.samples...)
+		sort.Slice(tracker.sorted, func(i, j int) bool { return tracker.sorted[i] < tracker.sorted[j] })
+		tracker.dirty = 0
+	}
+
+	i := int(p / 100 * float64(len(tracker.sorted)))
+	if i >= len(tracker.sorted) {
+		i = len(tracker.sorted) - 1
+	}
+
+	return tracker.sorted[i], true
+}
+
+// hedged indicates whether the response of a hedged request can be kept.
+func hedged(resp *Response) bool {
+	return resp.Error == nil && resp.Code < http.StatusInternalServerError
+}
+
+// hedge sends the request and, if it doesn't complete within the hedging
+// delay, sends additional requests to other hosts. The first successful
+// response is returned and the remaining requests are canceled. If all the
+// requests fail then the first failure is returned.
+func (req *Request) hedge(ctx context.Context) *Response {
+	delay, ok := req.Hedge.delay(req.REST)
+	if !ok {
+		return req.attempt(ctx, nil)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan *Response, req.Hedge.maxHedges()+1)
+	var hosts []string
+
+	launch := func() {
+		resp, endpoint := req.target(hosts)
+		if len(resp.Host) > 0 {
+			hosts = append(hosts, resp.Host)
+		}
+
+		if resp.Error != nil {
+			results <- resp
+			return
+		}
+
+		go func() { results <- req.attemptTo(ctx, resp, endpoint) }()
+	}
+
+	launch()
+	pending, hedges := 1, 0
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var failed *Response
+
+	for pending > 0 {
+		select {
+
+		case resp := <-results:
+			pending--
+
+			if hedged(resp) {
+				resp.Hedges = hedges
+				return resp
+			}
+
+			if failed == nil {
+				failed = resp
+			}
+
+		case <-timer.C:
+			if hedges < req.Hedge.maxHedges() {
+				launch()
+				pending++
+				hedges++
+				timer.Reset(delay)
+			}
+		}
+	}
+
+	failed.Hedges = hedges
+	return failed
+}
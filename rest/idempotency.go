@@ -0,0 +1,360 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// IdempotencyKeyHeader is the header which carries the idempotency key of
+	// a request.
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// ReplayedHeader is set on the responses replayed from an
+	// IdempotencyStore.
+	ReplayedHeader = "Idempotent-Replayed"
+
+	// DefaultIdempotencyTTL is the default duration for which the responses
+	// of Idempotent routes are stored.
+	DefaultIdempotencyTTL = 24 * time.Hour
+
+	// DefaultIdempotencyLease is the default duration for which the keys of
+	// Idempotent routes are held while their request is in flight.
+	DefaultIdempotencyLease = time.Minute
+
+	// DefaultIdempotencyEntries is the default maximum number of keys held by
+	// a MemoryIdempotencyStore.
+	DefaultIdempotencyEntries = 10000
+)
+
+// NewIdempotencyKey returns a new random idempotency key.
+func NewIdempotencyKey() string {
+	var key [16]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(key[:])
+}
+
+// SetIdempotencyKey sets the idempotency key of the request. Requests with a
+// non-idempotent method are given a key automatically if their retry policy
+// allows them to be retried.
+func (req *Request) SetIdempotencyKey(key string) *Request {
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set(IdempotencyKeyHeader, key)
+	return req
+}
+
+// StoredResponse is a response recorded by an IdempotencyStore.
+type StoredResponse struct {
+
+	// Code is the HTTP status code of the response.
+	Code int
+
+	// Header holds the headers of the response.
+	Header http.Header
+
+	// Body is the raw body of the response.
+	Body []byte
+
+	// Fingerprint is the hash of the body of the request which produced the
+	// response. Requests reusing the key with a different body are rejected.
+	Fingerprint string
+}
+
+// IdempotencyStore records the responses of the requests to Idempotent routes
+// such that they can be replayed when the requests are repeated.
+type IdempotencyStore interface {
+
+	// Reserve marks the key as in flight for at most the given lease.
+	// Returns the stored response if the key was already completed and false
+	// if the key is already in flight.
+	Reserve(key string, lease time.Duration) (*StoredResponse, bool, error)
+
+	// Complete stores the response of a reserved key for the given duration.
+	Complete(key string, resp *StoredResponse, ttl time.Duration) error
+
+	// Release removes the reservation of a key whose response shouldn't be
+	// stored such that the request can be repeated.
+	Release(key string) error
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore which keeps the responses in
+// memory. Once MaxEntries keys are held, the completed keys are evicted to
+// make room for new ones and new keys are rejected if all the keys are in
+// flight.
+type MemoryIdempotencyStore struct {
+
+	// MaxEntries is the maximum number of keys held by the store. Defaults
+	// to DefaultIdempotencyEntries.
+	MaxEntries int
+
+	mutex   sync.Mutex
+	entries map[string]idempotencyEntry
+	swept   time.Time
+}
+
+type idempotencyEntry struct {
+	resp    *StoredResponse
+	expires time.Time
+}
+
+// Reserve implements the IdempotencyStore interface.
+func (store *MemoryIdempotencyStore) Reserve(key string, lease time.Duration) (*StoredResponse, bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	store.sweep(now)
+
+	if entry, ok := store.entries[key]; ok && now.Before(entry.expires) {
+		return entry.resp, false, nil
+	}
+
+	if !store.evict(now) {
+		return nil, false, errors.New("too many idempotency keys in flight")
+	}
+
+	store.entries[key] = idempotencyEntry{expires: now.Add(lease)}
+	return nil, true, nil
+}
+
+func (store *MemoryIdempotencyStore) maxEntries() int {
+	if store.MaxEntries > 0 {
+		return store.MaxEntries
+	}
+	return DefaultIdempotencyEntries
+}
+
+// evict makes room for a new key by removing the expired keys and then the
+// completed keys. Returns false if all the keys are in flight.
+func (store *MemoryIdempotencyStore) evict(now time.Time) bool {
+	if len(store.entries) < store.maxEntries() {
+		return true
+	}
+
+	store.swept = time.Time{}
+	store.sweep(now)
+
+	for key, entry := range store.entries {
+		if len(store.entries) < store.maxEntries() {
+			break
+		}
+		if entry.resp != nil {
+			delete(store.entries, key)
+		}
+	}
+
+	return len(store.entries) < store.maxEntries()
+}
+
+// Complete implements the IdempotencyStore interface.
+func (store *MemoryIdempotencyStore) Complete(key string, resp *StoredResponse, ttl time.Duration) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.entries == nil {
+		store.entries = make(map[string]idempotencyEntry)
+	}
+
+	store.entries[key] = idempotencyEntry{resp, time.Now().Add(ttl)}
+	return nil
+}
+
+// Release implements the IdempotencyStore interface.
+func (store *MemoryIdempotencyStore) Release(key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.entries, key)
+	return nil
+}
+
+// Len returns the number of keys held by the store.
+func (store *MemoryIdempotencyStore) Len() int {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return len(store.entries)
+}
+
+// sweep removes the expired entries at most once a minute.
+func (store *MemoryIdempotencyStore) sweep(now time.Time) {
+	if store.entries == nil {
+		store.entries = make(map[string]idempotencyEntry)
+	}
+
+	if now.Sub(store.swept) < time.Minute {
+		return
+	}
+	store.swept = now
+
+	for key, entry := range store.entries {
+		if !now.Before(entry.expires) {
+			delete(store.entries, key)
+		}
+	}
+}
+
+// responseRecorder records the response written by the mux.
+type responseRecorder struct {
+	http.ResponseWriter
+
+	code int
+	body bytes.Buffer
+}
+
+func (recorder *responseRecorder) WriteHeader(code int) {
+	if recorder.code == 0 {
+		recorder.code = code
+	}
+	recorder.ResponseWriter.WriteHeader(code)
+}
+
+func (recorder *responseRecorder) Write(data []byte) (int, error) {
+	if recorder.code == 0 {
+		recorder.code = http.StatusOK
+	}
+	recorder.body.Write(data)
+	return recorder.ResponseWriter.Write(data)
+}
+
+func (route *Route) idempotencyTTL() time.Duration {
+	if route.IdempotencyTTL > 0 {
+		return route.IdempotencyTTL
+	}
+	return DefaultIdempotencyTTL
+}
+
+func (route *Route) idempotencyLease() time.Duration {
+	if route.IdempotencyLease > 0 {
+		return route.IdempotencyLease
+	}
+	return DefaultIdempotencyLease
+}
+
+// idempotencyKey returns the key under which the response of the request is
+// stored. Keys are scoped to the path of the request and to its principal.
+func idempotencyKey(httpReq *http.Request, principal *Principal, key string) string {
+	subject := "-"
+	if principal != nil {
+		subject = strconv.Quote(principal.Subject)
+	}
+
+	return strings.Join([]string{httpReq.Method, strconv.Quote(httpReq.URL.EscapedPath()), subject, strconv.Quote(key)}, " ")
+}
+
+// fingerprint returns the hash of the given request body.
+func fingerprint(hash hash.Hash) string {
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// hashingBody hashes the body of a request as it's read.
+type hashingBody struct {
+	io.Reader
+	io.Closer
+}
+
+// idempotent calls serve unless the request carries an idempotency key which
+// was already seen by the mux in which case the stored response is replayed.
+// Requests whose key is in flight are rejected with a 409 status code and a
+// Retry-After header while requests whose body differs from the body of the
+// stored response are rejected with a 422 status code. Responses with a 5xx
+// status code are not stored. The body is nil if it wasn't read yet in which
+// case it's hashed as it's read by serve.
+func (mux *Mux) idempotent(writer http.ResponseWriter, httpReq *http.Request, route *Route, principal *Principal, body []byte, serve func(http.ResponseWriter)) {
+	header := httpReq.Header.Get(IdempotencyKeyHeader)
+	if !route.Idempotent || len(header) == 0 {
+		serve(writer)
+		return
+	}
+
+	key := idempotencyKey(httpReq, principal, header)
+	stored, reserved, err := mux.IdempotencyStore.Reserve(key, route.idempotencyLease())
+	if err != nil {
+		mux.respondError(writer, IdempotencyError, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	hash := sha256.New()
+	if body != nil {
+		hash.Write(body)
+	}
+
+	if stored != nil {
+		if body == nil {
+			if _, err := io.Copy(hash, httpReq.Body); err != nil {
+				mux.respondError(writer, ReadBodyError, readErrorCode(err), err)
+				return
+			}
+		}
+
+		if fingerprint(hash) != stored.Fingerprint {
+			err := errors.New("idempotency key reused with a different request body")
+			mux.respondError(writer, IdempotencyMismatch, http.StatusUnprocessableEntity, err)
+			return
+		}
+
+		for name, values := range stored.Header {
+			writer.Header()[name] = values
+		}
+		writer.Header().Set(ReplayedHeader, "true")
+		writer.WriteHeader(stored.Code)
+		writer.Write(stored.Body)
+		return
+	}
+
+	if !reserved {
+		writer.Header().Set("Retry-After", "1")
+		err := errors.New("a request with the same idempotency key is in progress")
+		mux.respondError(writer, IdempotencyConflict, http.StatusConflict, err)
+		return
+	}
+
+	recorder := &responseRecorder{ResponseWriter: writer}
+	completed := false
+
+	defer func() {
+		if !completed {
+			mux.IdempotencyStore.Release(key)
+		}
+	}()
+
+	if body == nil {
+		httpReq.Body = &hashingBody{io.TeeReader(httpReq.Body, hash), httpReq.Body}
+	}
+
+	serve(recorder)
+
+	if recorder.code == 0 || recorder.code >= http.StatusInternalServerError {
+		return
+	}
+
+	if body == nil {
+		io.Copy(ioutil.Discard, httpReq.Body)
+	}
+
+	resp := &StoredResponse{
+		Code:        recorder.code,
+		Header:      writer.Header().Clone(),
+		Body:        recorder.body.Bytes(),
+		Fingerprint: fingerprint(hash),
+	}
+
+	completed = mux.IdempotencyStore.Complete(key, resp, route.idempotencyTTL()) == nil
+}
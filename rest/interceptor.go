@@ -0,0 +1,47 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"context"
+)
+
+// Sender sends a request and returns its response.
+type Sender func(ctx context.Context, req *Request) *Response
+
+// Interceptor wraps the sending of every request originating from a Client.
+// An interceptor can inspect or modify the request before calling next to send
+// it and can inspect or modify the response returned by next. It can also
+// short-circuit the request by returning a response without calling next.
+// Interceptors must never return a nil response.
+//
+// Interceptors see the headers of the client already copied into the request
+// and run before any slot of Client.Limit is taken such that short-circuited
+// requests don't count against the limit. Calling next sends the request with
+// all its attempts as controlled by the retry and hedging policies.
+type Interceptor func(ctx context.Context, req *Request, next Sender) *Response
+
+// intercept sends the request through the interceptors of the client with
+// send being called at the end of the chain.
+func (client *Client) intercept(ctx context.Context, req *Request, send Sender) *Response {
+	next := send
+
+	if client.ETags != nil {
+		next = func(ctx context.Context, req *Request) *Response {
+			return client.ETags.Intercept(ctx, req, send)
+		}
+	}
+
+	for i := len(client.Interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := client.Interceptors[i], next
+		next = func(ctx context.Context, req *Request) *Response {
+			return interceptor(ctx, req, inner)
+		}
+	}
+
+	resp := next(ctx, req)
+	if resp.Request == nil {
+		resp.Request = req
+	}
+	return resp
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// limiter bounds the number of concurrent requests of a client. Requests that
+// can't be sent immediately are queued and served by decreasing priority and
+// then in the order in which they were queued.
+type limiter struct {
+	mutex sync.Mutex
+
+	capacity int
+	maxQueue int
+	timeout  time.Duration
+
+	inFlight int
+	waiters  []*waiter
+	seq      uint64
+}
+
+type waiter struct {
+	priority int
+	seq      uint64
+	ready    chan struct{}
+}
+
+// before indicates whether the waiter should be served before the other.
+func (w *waiter) before(other *waiter) bool {
+	if w.priority != other.priority {
+		return w.priority > other.priority
+	}
+	return w.seq < other.seq
+}
+
+// counts returns the number of requests in flight and queued.
+func (limiter *limiter) counts() (inFlight, queued int) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	return limiter.inFlight, len(limiter.waiters)
+}
+
+// acquire reserves a slot for a request with the given priority, waiting if
+// necessary until a slot is released, the context is done or the timeout of
+// the limiter expires.
+func (limiter *limiter) acquire(ctx context.Context, priority int) *Error {
+	limiter.mutex.Lock()
+
+	if limiter.capacity == 0 || limiter.inFlight < limiter.capacity && len(limiter.waiters) == 0 {
+		limiter.inFlight++
+		limiter.mutex.Unlock()
+		return nil
+	}
+
+	if limiter.maxQueue > 0 && len(limiter.waiters) >= limiter.maxQueue {
+		limiter.mutex.Unlock()
+		return ErrorFmt(LimitExceeded, "too many queued requests: %d", limiter.maxQueue)
+	}
+
+	w := &waiter{priority: priority, seq: limiter.seq, ready: make(chan struct{})}
+	limiter.seq++
+
+	i := sort.Search(len(limiter.waiters), func(i int) bool { return w.before(limiter.waiters[i]) })
+	limiter.waiters = append(limiter.waiters, nil)
+	copy(limiter.waiters[i+1:], limiter.waiters[i:])
+	limiter.waiters[i] = w
+
+	limiter.mutex.Unlock()
+
+	var expired <-chan time.Time
+	if limiter.timeout > 0 {
+		timer := time.NewTimer(limiter.timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var err *Error
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		err = contextError(ctx)
+	case <-expired:
+		err = ErrorFmt(LimitExceeded, "no slot available after %s", limiter.timeout)
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	for i, other := range limiter.waiters {
+		if other == w {
+			limiter.waiters = append(limiter.waiters[:i], limiter.waiters[i+1:]...)
+			return err
+		}
+	}
+
+	// The slot was handed over while giving up so it must be passed on.
+	limiter.handOver()
+	return err
+}
+
+// release frees the slot of a request.
+func (limiter *limiter) release() {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.handOver()
+}
+
+// handOver gives the slot of a request to the next queued request, if any.
+func (limiter *limiter) handOver() {
+	if len(limiter.waiters) == 0 || limiter.capacity == 0 {
+		limiter.inFlight--
+		return
+	}
+
+	w := limiter.waiters[0]
+	limiter.waiters = limiter.waiters[1:]
+	close(w.ready)
+}
@@ -5,10 +5,15 @@ package rest
 import (
 	"bytes"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
+	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
@@ -37,9 +42,44 @@ type Mux struct {
 
 	DefaultHandler http.Handler
 
+	// Authenticator establishes the identity of the callers of the routes. If
+	// set then requests without valid credentials are rejected with an
+	// Unauthorized error unless their route is Public and requests whose
+	// principal doesn't satisfy the Scopes and Roles of their route are
+	// rejected with a Forbidden error.
+	Authenticator Authenticator
+
+	// Throttle limits the load accepted by the mux across all its routes. It
+	// applies to the requests before their body is read except for the rate
+	// limit of an Authenticated throttle which applies once they're
+	// authenticated.
+	Throttle *Throttle
+
+	// IdempotencyStore records the responses of the Idempotent routes.
+	// Defaults to a MemoryIdempotencyStore.
+	IdempotencyStore IdempotencyStore
+
+	// DocPath is the path under Root where the HTML documentation of the
+	// registered routes is served. Defaults to "documentation" and can be
+	// disabled by setting it to "-". Must be set before calling Init.
+	DocPath string
+
+	// TrustForwardedProto uses the X-Forwarded-Proto header of the requests
+	// to build the URLs of the documentation. Should only be set if the mux
+	// is behind a proxy which sets the header.
+	TrustForwardedProto bool
+
+	// DocAuth is called before serving the documentation page. If it returns
+	// an error then the page is not served and the error is returned to the
+	// client with a 403 status code, unless a rest.CodedError is returned.
+	DocAuth func(*http.Request) error
+
 	initialize sync.Once
 
 	router router
+	names  map[string]*Route
+
+	docTemplate *template.Template
 }
 
 // Init initializes the object.
@@ -57,6 +97,28 @@ func (mux *Mux) init() {
 	if mux.DefaultHandler == nil {
 		mux.DefaultHandler = http.DefaultServeMux
 	}
+
+	if mux.IdempotencyStore == nil {
+		mux.IdempotencyStore = &MemoryIdempotencyStore{}
+	}
+
+	if len(mux.DocPath) == 0 {
+		mux.DocPath = JoinPath(mux.Root, "documentation")
+	} else if mux.DocPath != "-" {
+		mux.DocPath = JoinPath(mux.Root, mux.DocPath)
+	}
+
+	if mux.DocPath != "-" {
+		funcMap := make(template.FuncMap)
+		funcMap["Split"] = strings.Split
+		funcMap["Contains"] = strings.Contains
+
+		var err error
+		t := template.New("documentation").Funcs(funcMap)
+		if mux.docTemplate, err = t.Parse(documentation); err != nil {
+			log.Panicf("unable to parse documentation template: %s", err)
+		}
+	}
 }
 
 // AddRoute adds all the given routes to the mux.
@@ -65,6 +127,20 @@ func (mux *Mux) AddRoute(routes ...*Route) {
 
 	for _, route := range routes {
 		mux.router.Add(route)
+
+		if len(route.Name) == 0 {
+			continue
+		}
+
+		if mux.names == nil {
+			mux.names = make(map[string]*Route)
+		}
+
+		if _, ok := mux.names[route.Name]; ok {
+			log.Panicf("duplicate route name: %s", route.Name)
+		}
+
+		mux.names[route.Name] = route
 	}
 }
 
@@ -75,14 +151,60 @@ func (mux *Mux) AddService(routables ...Routable) {
 	}
 }
 
+// Routes returns all the routes registered with the mux sorted by path.
+func (mux *Mux) Routes() Routes {
+	mux.Init()
+
+	routes := mux.router.PrintRoutes(make(Routes, 0))
+	sort.Sort(routes)
+	return routes
+}
+
+// URL builds the absolute path, including Root, of the route with the given
+// name using the given path arguments. See Path.Format for further details.
+func (mux *Mux) URL(name string, args ...interface{}) (string, error) {
+	mux.Init()
+
+	route, ok := mux.names[name]
+	if !ok {
+		return "", fmt.Errorf("unknown route name: '%s'", name)
+	}
+
+	path, err := route.Path.Format(args...)
+	if err != nil {
+		return "", err
+	}
+
+	return JoinPath(mux.Root, path), nil
+}
+
+// route returns the route matching the given escaped path along with its
+// arguments. The path is split before its segments are unescaped such that
+// escaped slashes don't split the arguments.
 func (mux *Mux) route(method, path string) (*Route, []string, error) {
-	if strings.HasPrefix(path, mux.Root) {
-		sub := path[len(mux.Root):]
-		if route, args := mux.router.Route(method, sub); route != nil {
-			return route, args, nil
+	split := SplitPath(path)
+	for i, item := range split {
+		var err error
+		if split[i], err = url.PathUnescape(item); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	root := SplitPath(mux.Root)
+	if len(split) < len(root) {
+		return nil, nil, fmt.Errorf("unknown path: '%s'", path)
+	}
+
+	for i, item := range root {
+		if split[i] != item {
+			return nil, nil, fmt.Errorf("unknown path: '%s'", path)
 		}
 	}
 
+	if route, args := mux.router.route(method, split[len(root):], nil); route != nil {
+		return route, args, nil
+	}
+
 	return nil, nil, fmt.Errorf("unknown path: '%s'", path)
 }
 
@@ -99,42 +221,87 @@ func (mux *Mux) respondError(writer http.ResponseWriter, errType ErrorType, code
 	http.Error(writer, err.Error(), code)
 }
 
+func (mux *Mux) serveDocumentation(writer http.ResponseWriter, httpReq *http.Request) {
+	if mux.DocAuth != nil {
+		if err := mux.DocAuth(httpReq); err != nil {
+			mux.respondError(writer, DocumentationError, http.StatusForbidden, err)
+			return
+		}
+	}
+
+	scheme := "http"
+	if httpReq.TLS != nil {
+		scheme = "https"
+	}
+	if proto := httpReq.Header.Get("X-Forwarded-Proto"); mux.TrustForwardedProto && (proto == "http" || proto == "https") {
+		scheme = proto
+	}
+
+	page := struct {
+		Host    string
+		BaseURL string
+		Routes  Routes
+	}{
+		httpReq.Host,
+		scheme + "://" + httpReq.Host + strings.TrimRight(mux.Root, "/"),
+		mux.Routes(),
+	}
+
+	var body bytes.Buffer
+	if err := mux.docTemplate.Execute(&body, page); err != nil {
+		mux.respondError(writer, DocumentationError, http.StatusInternalServerError, err)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Write(body.Bytes())
+}
+
 // ServeHTTP services incoming HTTP request by routing them to one of the
 // registered routes. Handles all marshalling of input and outputs as well as
 // any required path parsing.
 func (mux *Mux) ServeHTTP(writer http.ResponseWriter, httpReq *http.Request) {
 	mux.Init()
 
-	if httpReq.URL.Path == "/documentation" {
-		funcMap := make(template.FuncMap)
-		funcMap["Split"] = strings.Split
-		funcMap["Contains"] = strings.Contains
-		t, err := template.New("documentation").Funcs(funcMap).Parse(documentation)
-		if err != nil {
-			mux.respondError(writer, "html-template-error", http.StatusBadRequest, err)
-			return
-		}
-
-		routes := mux.router.PrintRoutes(make(Routes, 0))
-		sort.Sort(routes)
-
-		page := struct {
-			Host   string
-			Routes Routes
-		}{
-			httpReq.Host,
-			routes,
-		}
-		t.Execute(writer, page)
+	if mux.docTemplate != nil && httpReq.URL.Path == mux.DocPath {
+		mux.serveDocumentation(writer, httpReq)
 		return
 	}
 
-	route, args, err := mux.route(httpReq.Method, httpReq.URL.Path)
+	route, args, err := mux.route(httpReq.Method, httpReq.URL.EscapedPath())
 	if err != nil {
 		mux.DefaultHandler.ServeHTTP(writer, httpReq)
 		return
 	}
 
+	admission, ok := mux.throttle(writer, httpReq, route)
+	if !ok {
+		return
+	}
+	defer admission.release()
+
+	if route.MaxBodySize > 0 {
+		httpReq.Body = http.MaxBytesReader(writer, httpReq.Body, route.MaxBodySize)
+	}
+
+	if route.form {
+		principal, ok := mux.authenticate(writer, httpReq, route, nil)
+		if !ok {
+			return
+		}
+
+		if !mux.throttleAuthenticated(writer, httpReq, admission, principal) {
+			return
+		}
+
+		mux.idempotent(writer, httpReq, route, principal, nil, func(writer http.ResponseWriter) {
+			if precondition, ok := mux.precondition(writer, httpReq, route, args); ok {
+				mux.serveForm(writer, httpReq, route, principal, precondition, args)
+			}
+		})
+		return
+	}
+
 	if httpReq.Method != "GET" {
 		if contentType := httpReq.Header.Get("Content-Type"); contentType != "application/json" {
 			err := fmt.Errorf("unsupported content type: got '%s' expected 'application/json'", contentType)
@@ -143,41 +310,177 @@ func (mux *Mux) ServeHTTP(writer http.ResponseWriter, httpReq *http.Request) {
 		}
 	}
 
-	var body []byte
+	raw, err := ioutil.ReadAll(httpReq.Body)
+	if err != nil {
+		mux.respondError(writer, ReadBodyError, readErrorCode(err), err)
+		return
+	}
+
+	// A nil body is reserved for multipart requests whose body can't be
+	// authenticated.
+	if raw == nil {
+		raw = []byte{}
+	}
+
+	body := raw
 	if contentEncoding := httpReq.Header.Get("Content-Encoding"); contentEncoding == "gzip" {
-		gz, err := gzip.NewReader(httpReq.Body)
-		defer gz.Close()
-		if err != nil {
-			err := fmt.Errorf("decoding gzip content failed: %s", err)
-			mux.respondError(writer, GzipError, http.StatusBadRequest, err)
+		if body, err = gunzip(raw, route.MaxBodySize); err != nil {
+			mux.respondError(writer, GzipError, readErrorCode(err), err)
 			return
 		}
-		body, err = ioutil.ReadAll(gz)
-		if err != nil {
-			err := fmt.Errorf("decoding gzip content failed: %s", err)
-			mux.respondError(writer, GzipError, http.StatusBadRequest, err)
+	}
+
+	principal, ok := mux.authenticate(writer, httpReq, route, raw)
+	if !ok {
+		return
+	}
+
+	if !mux.throttleAuthenticated(writer, httpReq, admission, principal) {
+		return
+	}
+
+	// Requests are replayed before their precondition is checked since the
+	// version of the resource moved on once the original request completed.
+	mux.idempotent(writer, httpReq, route, principal, raw, func(writer http.ResponseWriter) {
+		precondition, ok := mux.precondition(writer, httpReq, route, args)
+		if !ok {
 			return
 		}
-	} else {
-		var err error
-		body, err = ioutil.ReadAll(httpReq.Body)
-		if err != nil {
-			mux.respondError(writer, ReadBodyError, http.StatusBadRequest, err)
-			return
+
+		out, restError := route.cached(principal, args, func() (*output, *Error) {
+			return route.invokeAs(principal, precondition, args, body)
+		})
+		mux.respond(writer, httpReq, route, out, restError)
+	})
+}
+
+// gunzip decompresses the given body while enforcing the maximum size of the
+// body, if any.
+func gunzip(body []byte, maxSize int64) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("decoding gzip content failed: %s", err)
+	}
+	defer gz.Close()
+
+	var reader io.Reader = gz
+	if maxSize > 0 {
+		reader = io.LimitReader(gz, maxSize+1)
+	}
+
+	if body, err = ioutil.ReadAll(reader); err != nil {
+		return nil, fmt.Errorf("decoding gzip content failed: %s", err)
+	}
+
+	if maxSize > 0 && int64(len(body)) > maxSize {
+		return nil, &http.MaxBytesError{Limit: maxSize}
+	}
+
+	return body, nil
+}
+
+// authenticate establishes the principal of the request using the
+// Authenticator of the mux and checks that it satisfies the requirements of
+// the route. Returns false if the request was rejected in which case the
+// error was already written to the response.
+func (mux *Mux) authenticate(writer http.ResponseWriter, httpReq *http.Request, route *Route, body []byte) (*Principal, bool) {
+	if mux.Authenticator == nil {
+		return nil, true
+	}
+
+	principal, err := mux.Authenticator.Authenticate(httpReq, body)
+	if err != nil {
+		mux.respondError(writer, Unauthorized, http.StatusUnauthorized, err)
+		return nil, false
+	}
+
+	if principal == nil {
+		if route.Public {
+			return nil, true
 		}
+
+		mux.respondError(writer, Unauthorized, http.StatusUnauthorized, errors.New("missing credentials"))
+		return nil, false
 	}
 
-	resp, restError := route.invoke(args, body)
+	if err := route.authorize(principal); err != nil {
+		mux.respondError(writer, Forbidden, http.StatusForbidden, err)
+		return nil, false
+	}
+
+	return principal, true
+}
+
+// serveForm binds the parts of a multipart/form-data request to the body
+// argument of the route's handler. Large parts are stored in temporary files
+// which are removed once the handler returns.
+func (mux *Mux) serveForm(writer http.ResponseWriter, httpReq *http.Request, route *Route, principal *Principal, precondition *Precondition, args []string) {
+	mediaType, _, _ := mime.ParseMediaType(httpReq.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		err := fmt.Errorf("unsupported content type: got '%s' expected 'multipart/form-data'", mediaType)
+		mux.respondError(writer, UnsupportedContentType, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := httpReq.ParseMultipartForm(route.maxMemory()); err != nil {
+		mux.respondError(writer, ReadBodyError, readErrorCode(err), err)
+		return
+	}
+	defer httpReq.MultipartForm.RemoveAll()
+
+	out, restError := route.invokeForm(principal, precondition, args, httpReq.MultipartForm)
+	mux.respond(writer, httpReq, route, out, restError)
+}
+
+// tooLarge indicates whether the error was caused by a request body exceeding
+// the size limit of its route.
+func tooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+func readErrorCode(err error) int {
+	if tooLarge(err) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// respond writes the result of the invocation of a route's handler. The
+// responses of GET routes carry an ETag and conditional requests whose
+// entity is unchanged are answered with a 304 status code. The ETag of
+// compressed responses is suffixed with their encoding.
+func (mux *Mux) respond(writer http.ResponseWriter, httpReq *http.Request, route *Route, out *output, restError *Error) {
 	if restError != nil {
 		mux.respondError(writer, restError.Type, http.StatusBadRequest, restError.Sub)
 		return
 	}
 
+	resp := out.body
+
 	if len(resp) == 0 {
 		writer.WriteHeader(http.StatusNoContent)
 	} else {
 		header := writer.Header()
 
+		etag := out.etag
+		if route.GzipLevel != 0 {
+			etag = encodeETag(etag, "gzip")
+			header.Set("Vary", "Accept-Encoding")
+		}
+
+		if len(etag) > 0 {
+			header.Set("ETag", etag)
+		}
+		if !out.modified.IsZero() {
+			header.Set("Last-Modified", out.modified.Format(http.TimeFormat))
+		}
+
+		if httpReq.Method == "GET" && notModified(httpReq, etag, out.modified) {
+			writer.WriteHeader(http.StatusNotModified)
+			return
+		}
+
 		if route.GzipLevel != 0 {
 			var body bytes.Buffer
 			gz, _ := gzip.NewWriterLevel(&body, route.GzipLevel)
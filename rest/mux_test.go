@@ -5,8 +5,16 @@ package rest
 import (
 	"compress/gzip"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -216,3 +224,881 @@ func TestMuxSimple(t *testing.T) {
 	checkRespBody(t, "g(a)", r30, &KV{"a", "1"})
 
 }
+
+func checkDoc(t *testing.T, title string, mux *Mux, path string, exp int) {
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Errorf("FAIL(%s): unexpected error %s", title, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != exp {
+		t.Errorf("FAIL(%s): unexpected code: %d != %d", title, resp.StatusCode, exp)
+	}
+}
+
+func TestMuxDocumentation(t *testing.T) {
+	notFound := http.NotFoundHandler()
+
+	checkDoc(t, "default", &Mux{DefaultHandler: notFound}, "/documentation", 200)
+
+	rooted := &Mux{Root: "/api", DefaultHandler: notFound}
+	checkDoc(t, "rooted", rooted, "/api/documentation", 200)
+	checkDoc(t, "rooted-outside", rooted, "/documentation", 404)
+
+	custom := &Mux{DocPath: "/docs", DefaultHandler: notFound}
+	checkDoc(t, "custom", custom, "/docs", 200)
+
+	customRooted := &Mux{Root: "/api", DocPath: "docs", DefaultHandler: notFound}
+	checkDoc(t, "custom-rooted", customRooted, "/api/docs", 200)
+
+	disabled := &Mux{DocPath: "-", DefaultHandler: notFound}
+	checkDoc(t, "disabled", disabled, "/documentation", 404)
+
+	auth := &Mux{
+		DefaultHandler: notFound,
+		DocAuth:        func(*http.Request) error { return fmt.Errorf("denied") },
+	}
+	checkDoc(t, "auth", auth, "/documentation", 403)
+
+	forwarded := func(title string, mux *Mux, exp string) {
+		mux.AddRoute(NewRoute("/ping", "PUT", func() {}))
+
+		server := httptest.NewServer(mux)
+		defer server.Close()
+
+		req, _ := http.NewRequest("GET", server.URL+"/documentation", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("FAIL(%s): unexpected error %s", title, err)
+			return
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		if !strings.Contains(string(body), "'"+exp+`:\/\/`+req.Host) {
+			t.Errorf("FAIL(%s): missing scheme '%s'", title, exp)
+		}
+	}
+
+	forwarded("forwarded-untrusted", &Mux{DefaultHandler: notFound}, "http")
+	forwarded("forwarded-trusted", &Mux{DefaultHandler: notFound, TrustForwardedProto: true}, "https")
+}
+
+func TestMuxURL(t *testing.T) {
+	get := NewNamedRoute("get", "/echo/:a/:b", "GET", func(a string, b int) string {
+		return fmt.Sprintf("%s-%d", a, b)
+	})
+
+	mux := &Mux{Root: "/api"}
+	mux.AddRoute(get)
+
+	if url, err := mux.URL("get", "x y/z", 10); err != nil {
+		t.Errorf("FAIL(url): unexpected error %s", err)
+	} else if exp := "/api/echo/x%20y%2Fz/10"; url != exp {
+		t.Errorf("FAIL(url): unexpected url: %s != %s", url, exp)
+	}
+
+	if _, err := mux.URL("get", "x"); err == nil {
+		t.Errorf("FAIL(url-args): expected error")
+	}
+
+	if _, err := mux.URL("unknown"); err == nil {
+		t.Errorf("FAIL(url-unknown): expected error")
+	}
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := &Client{Host: server.URL, Root: "/api"}
+
+	var result string
+	resp := client.NewRouteRequest(get, "x y/z", 10).Send()
+	if err := resp.GetBody(&result); err != nil {
+		t.Errorf("FAIL(route): unexpected error %s", err)
+	} else if exp := "x y/z-10"; result != exp {
+		t.Errorf("FAIL(route): unexpected result: %s != %s", result, exp)
+	}
+
+	// Static segments and the root are matched once unescaped.
+	unicode := &Mux{Root: "/été"}
+	unicode.AddRoute(NewRoute("/café/:a", "GET", func(a string) string { return a }))
+
+	escaped := httptest.NewServer(unicode)
+	defer escaped.Close()
+
+	resp = (&Client{Host: escaped.URL}).NewRequest("GET").SetPath("/%%C3%%A9t%%C3%%A9/caf%%C3%%A9/x%%2Fy").Send()
+	if err := resp.GetBody(&result); err != nil {
+		t.Errorf("FAIL(unicode): unexpected error %s", err)
+	} else if exp := "x/y"; result != exp {
+		t.Errorf("FAIL(unicode): unexpected result: %s != %s", result, exp)
+	}
+}
+
+type Upload struct {
+	Meta   KV                    `part:"meta"`
+	Note   string                `part:"note"`
+	File   io.Reader             `part:"file"`
+	Header *multipart.FileHeader `part:"file"`
+}
+
+func TestMuxMultipart(t *testing.T) {
+	upload := &Route{
+		Path:   NewPath("/upload/:id"),
+		Method: "POST",
+		Handler: func(id string, upload *Upload) (string, error) {
+			data, err := ioutil.ReadAll(upload.File)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s %s=%s %s %s:%s", id, upload.Meta.Key, upload.Meta.Val,
+				upload.Note, upload.Header.Filename, data), nil
+		},
+		MaxBodySize: 1 << 10,
+		MaxMemory:   16,
+	}
+
+	if !upload.IsMultipart() {
+		t.Errorf("FAIL(route): route is not multipart")
+	}
+
+	mux := &Mux{}
+	mux.AddRoute(upload)
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := &Client{Host: server.URL}
+
+	body := NewMultipart().
+		AddJSON("meta", KV{"a", "b"}).
+		AddField("note", "hello").
+		AddFile("file", "data.txt", strings.NewReader("larger than the memory limit"))
+
+	var result string
+	if err := client.NewRequest("POST").SetPath("/upload/x").SetMultipart(body).Send().GetBody(&result); err != nil {
+		t.Errorf("FAIL(upload): unexpected error: %s", err)
+	} else if exp := "x a=b hello data.txt:larger than the memory limit"; result != exp {
+		t.Errorf("FAIL(upload): unexpected result: %s != %s", result, exp)
+	}
+
+	resp := client.NewRequest("POST").SetPath("/upload/x").SetBody(KV{"a", "b"}).Send()
+	failResp(t, "json", resp, EndpointError, http.StatusBadRequest)
+
+	large := NewMultipart().AddFile("file", "large.txt", strings.NewReader(strings.Repeat("x", 2<<10)))
+	resp = client.NewRequest("POST").SetPath("/upload/x").SetMultipart(large).Send()
+	failResp(t, "too-large", resp, EndpointError, http.StatusRequestEntityTooLarge)
+}
+
+func TestMuxAuthentication(t *testing.T) {
+	secret := []byte("secret")
+
+	whoami := func(principal *Principal) string {
+		if principal == nil {
+			return "anonymous"
+		}
+		return principal.Subject
+	}
+
+	mux := &Mux{
+		Authenticator: Authenticators{
+			&JWTAuthenticator{Secret: secret, Issuer: "test"},
+			BasicAuthenticator(func(username, password string) (*Principal, error) {
+				if password != "pass" {
+					return nil, fmt.Errorf("invalid password")
+				}
+				return &Principal{Subject: username, Roles: []string{"user"}}, nil
+			}),
+			&HMACAuthenticator{Keys: map[string][]byte{"key": secret}},
+		},
+	}
+
+	mux.AddRoute(&Route{Path: NewPath("/whoami"), Method: "GET", Handler: whoami})
+	mux.AddRoute(&Route{Path: NewPath("/public"), Method: "GET", Handler: whoami, Public: true})
+	mux.AddRoute(&Route{Path: NewPath("/scoped"), Method: "GET", Handler: whoami, Scopes: []string{"read", "write"}})
+	mux.AddRoute(&Route{Path: NewPath("/admin"), Method: "GET", Handler: whoami, Roles: []string{"admin", "root"}})
+	mux.AddRoute(&Route{Path: NewPath("/upload"), Method: "POST", Handler: func(principal *Principal, upload *Upload) string {
+		return principal.Subject + ":" + upload.Note
+	}})
+	mux.AddRoute(&Route{
+		Path:   NewPath("/echo/:key"),
+		Method: "POST",
+		Handler: func(principal *Principal, key string, kv KV) string {
+			return principal.Subject + ":" + key + ":" + kv.Val
+		},
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	token := func(claims map[string]interface{}) Credentials {
+		jwt, err := NewJWT(secret, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return BearerToken(jwt)
+	}
+
+	check := func(title string, auth Credentials, req *Request, exp string) {
+		var result string
+		req.REST.Auth = auth
+		if err := req.Send().GetBody(&result); err != nil {
+			t.Errorf("FAIL(%s): unexpected error: %s", title, err)
+		} else if result != exp {
+			t.Errorf("FAIL(%s): unexpected result: %s != %s", title, result, exp)
+		}
+	}
+
+	fail := func(title string, auth Credentials, req *Request, exp ErrorType, code int) {
+		req.REST.Auth = auth
+		failResp(t, title, req.Send(), exp, code)
+	}
+
+	get := func(path string) *Request {
+		client := &Client{Host: server.URL}
+		return client.NewRequest("GET").SetPath(path)
+	}
+
+	alice := token(map[string]interface{}{"sub": "alice", "iss": "test", "scope": "read write"})
+
+	check("jwt", alice, get("/whoami"), "alice")
+	check("scoped", alice, get("/scoped"), "alice")
+	check("basic", &BasicAuth{Username: "bob", Password: "pass"}, get("/whoami"), "bob")
+	check("hmac", &HMACSigner{KeyID: "key", Secret: secret}, get("/whoami"), "key")
+	check("public", nil, get("/public"), "anonymous")
+	check("public-auth", alice, get("/public"), "alice")
+
+	client := &Client{Host: server.URL}
+	check("principal-arg", alice, client.NewRequest("POST").SetPath("/echo/k").SetBody(KV{"k", "v"}), "alice:k:v")
+	check("hmac-body", &HMACSigner{KeyID: "key", Secret: secret}, client.NewRequest("POST").SetPath("/echo/k").SetBody(KV{"k", "v"}), "key:k:v")
+
+	expired := token(map[string]interface{}{"sub": "alice", "iss": "test", "exp": time.Now().Add(-time.Minute).Unix()})
+	other := token(map[string]interface{}{"sub": "alice", "iss": "other"})
+	forged, _ := NewJWT([]byte("forged"), map[string]interface{}{"sub": "alice", "iss": "test"})
+
+	fail("missing", nil, get("/whoami"), EndpointError, http.StatusUnauthorized)
+	fail("expired", expired, get("/whoami"), EndpointError, http.StatusUnauthorized)
+	fail("issuer", other, get("/whoami"), EndpointError, http.StatusUnauthorized)
+	fail("forged", BearerToken(forged), get("/whoami"), EndpointError, http.StatusUnauthorized)
+	fail("password", &BasicAuth{Username: "bob", Password: "wrong"}, get("/whoami"), EndpointError, http.StatusUnauthorized)
+	fail("hmac-secret", &HMACSigner{KeyID: "key", Secret: []byte("wrong")}, get("/whoami"), EndpointError, http.StatusUnauthorized)
+	fail("scope", token(map[string]interface{}{"sub": "alice", "iss": "test", "scope": "read"}), get("/scoped"), EndpointError, http.StatusForbidden)
+	fail("role", &BasicAuth{Username: "bob", Password: "pass"}, get("/admin"), EndpointError, http.StatusForbidden)
+
+	check("role", token(map[string]interface{}{"sub": "root", "iss": "test", "roles": []string{"root"}}), get("/admin"), "root")
+
+	// The body of a multipart request isn't available to the authenticator so
+	// a signature over an empty body must not authorize any multipart body.
+	var tampered strings.Builder
+	form := multipart.NewWriter(&tampered)
+	form.WriteField("note", "tampered")
+	form.Close()
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := Signature(secret, "POST", "/upload", timestamp, nil)
+
+	httpReq, _ := http.NewRequest("POST", server.URL+"/upload", strings.NewReader(tampered.String()))
+	httpReq.Header.Set("Content-Type", form.FormDataContentType())
+	httpReq.Header.Set("Authorization", HMACScheme+" key:"+signature)
+	httpReq.Header.Set(TimestampHeader, timestamp)
+
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		t.Fatalf("FAIL(hmac-multipart): unexpected error: %s", err)
+	}
+	httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("FAIL(hmac-multipart): unexpected code: %d != %d", httpResp.StatusCode, http.StatusUnauthorized)
+	}
+
+	upload := client.NewRequest("POST").SetPath("/upload").SetMultipart(NewMultipart().AddField("note", "jwt"))
+	check("jwt-multipart", alice, upload, "alice:jwt")
+}
+
+type Document struct {
+	Text     string    `json:"text"`
+	Version  int       `json:"version"`
+	Modified time.Time `json:"-"`
+}
+
+func (doc *Document) ETag() string { return fmt.Sprintf("v%d", doc.Version) }
+
+func (doc *Document) LastModified() time.Time { return doc.Modified }
+
+func TestMuxConditional(t *testing.T) {
+	modified := time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+	calls := 0
+
+	mux := &Mux{}
+	mux.AddRoute(&Route{Path: NewPath("/hashed/:key"), Method: "GET", Handler: func(key string) string {
+		return "value-" + key
+	}})
+	mux.AddRoute(&Route{Path: NewPath("/doc"), Method: "GET", Handler: func() *Document {
+		return &Document{Text: "text", Version: 3, Modified: modified}
+	}})
+	mux.AddRoute(&Route{Path: NewPath("/gzip/doc"), Method: "GET", GzipLevel: gzip.BestSpeed, Handler: func() *Document {
+		return &Document{Text: "text", Version: 3}
+	}})
+	mux.AddRoute(&Route{Path: NewPath("/cached/:key"), Method: "GET", CacheTTL: time.Hour, Handler: func(key string) int {
+		calls++
+		return calls
+	}})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(title, path string, header http.Header, expCode int) *http.Response {
+		httpReq, _ := http.NewRequest("GET", server.URL+path, nil)
+		for name, values := range header {
+			httpReq.Header[name] = values
+		}
+
+		httpResp, err := http.DefaultClient.Do(httpReq)
+		if err != nil {
+			t.Fatalf("FAIL(%s): unexpected error: %s", title, err)
+		}
+		httpResp.Body.Close()
+
+		if httpResp.StatusCode != expCode {
+			t.Errorf("FAIL(%s): unexpected code: %d != %d", title, httpResp.StatusCode, expCode)
+		}
+		return httpResp
+	}
+
+	etag := get("hashed", "/hashed/a", nil, http.StatusOK).Header.Get("ETag")
+	if len(etag) == 0 || etag == get("hashed-other", "/hashed/b", nil, http.StatusOK).Header.Get("ETag") {
+		t.Errorf("FAIL(hashed): unexpected etag: '%s'", etag)
+	}
+
+	get("if-none-match", "/hashed/a", http.Header{"If-None-Match": {etag}}, http.StatusNotModified)
+	get("if-none-match-weak", "/hashed/a", http.Header{"If-None-Match": {`"other", W/` + etag}}, http.StatusNotModified)
+	get("if-none-match-star", "/hashed/a", http.Header{"If-None-Match": {"*"}}, http.StatusNotModified)
+	get("if-none-match-changed", "/hashed/b", http.Header{"If-None-Match": {etag}}, http.StatusOK)
+
+	httpResp := get("tagged", "/doc", nil, http.StatusOK)
+	if etag := httpResp.Header.Get("ETag"); etag != `"v3"` {
+		t.Errorf("FAIL(tagged): unexpected etag: '%s'", etag)
+	}
+	if lastModified := httpResp.Header.Get("Last-Modified"); lastModified != modified.Format(http.TimeFormat) {
+		t.Errorf("FAIL(tagged): unexpected last modified: '%s'", lastModified)
+	}
+
+	get("tagged-match", "/doc", http.Header{"If-None-Match": {`"v3"`}}, http.StatusNotModified)
+	get("tagged-stale", "/doc", http.Header{"If-None-Match": {`"v2"`}}, http.StatusOK)
+	get("modified-since", "/doc", http.Header{"If-Modified-Since": {modified.Format(http.TimeFormat)}}, http.StatusNotModified)
+	get("modified-before", "/doc", http.Header{"If-Modified-Since": {modified.Add(-time.Hour).Format(http.TimeFormat)}}, http.StatusOK)
+	get("none-match-wins", "/doc", http.Header{
+		"If-None-Match":     {`"v2"`},
+		"If-Modified-Since": {modified.Format(http.TimeFormat)},
+	}, http.StatusOK)
+
+	// Compressed responses don't share the strong entity tag of the entity.
+	httpResp = get("gzip", "/gzip/doc", nil, http.StatusOK)
+	if etag, vary := httpResp.Header.Get("ETag"), httpResp.Header.Get("Vary"); etag != `"v3-gzip"` || vary != "Accept-Encoding" {
+		t.Errorf("FAIL(gzip): unexpected headers: '%s' '%s'", etag, vary)
+	}
+
+	httpResp = get("gzip-match", "/gzip/doc", http.Header{"If-None-Match": {`"v3-gzip"`}}, http.StatusNotModified)
+	if vary := httpResp.Header.Get("Vary"); vary != "Accept-Encoding" {
+		t.Errorf("FAIL(gzip-match): unexpected vary: '%s'", vary)
+	}
+
+	if precondition := (&Precondition{ETags: []string{`"v3-gzip"`}}); !precondition.Match("v3") {
+		t.Errorf("FAIL(gzip-precondition): compressed entity tag doesn't match")
+	}
+
+	client := &Client{Host: server.URL}
+	cached := func(title, path string, exp int) {
+		var result int
+		if err := client.NewRequest("GET").SetPath(path).Send().GetBody(&result); err != nil {
+			t.Errorf("FAIL(%s): unexpected error: %s", title, err)
+		} else if result != exp {
+			t.Errorf("FAIL(%s): unexpected result: %d != %d", title, result, exp)
+		}
+	}
+
+	cached("cache-miss", "/cached/a", 1)
+	cached("cache-hit", "/cached/a", 1)
+	cached("cache-args", "/cached/b", 2)
+	cached("cache-args-hit", "/cached/b", 2)
+
+	for _, route := range mux.Routes() {
+		route.PurgeCache()
+	}
+	cached("cache-purged", "/cached/a", 3)
+}
+
+func TestMuxPrecondition(t *testing.T) {
+	var mutex sync.Mutex
+	docs := map[string]*Document{"a": {Text: "a", Version: 1}}
+
+	// Racing requests wait for each other once their version is checked.
+	var checked sync.WaitGroup
+	racing := int32(0)
+
+	version := func(key string) string {
+		mutex.Lock()
+		etag := ""
+		if doc, ok := docs[key]; ok {
+			etag = doc.ETag()
+		}
+		mutex.Unlock()
+
+		if atomic.LoadInt32(&racing) == 1 {
+			checked.Done()
+			checked.Wait()
+		}
+		return etag
+	}
+
+	mux := &Mux{}
+	mux.AddRoute(&Route{Path: NewPath("/doc/:key"), Method: "GET", Handler: func(key string) (*Document, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if doc, ok := docs[key]; ok {
+			return doc, nil
+		}
+		return nil, &CodedError{http.StatusNotFound, fmt.Errorf("unknown doc '%s'", key)}
+	}})
+	mux.AddRoute(&Route{
+		Path:           NewPath("/doc/:key"),
+		Method:         "PUT",
+		Version:        version,
+		RequireIfMatch: true,
+		Handler: func(precondition *Precondition, key string, text string) (*Document, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			// The version may have changed since it was checked by the mux.
+			doc, ok := docs[key]
+			if !ok || !precondition.Match(doc.ETag()) {
+				return nil, ErrPreconditionFailed
+			}
+
+			doc = &Document{Text: text, Version: doc.Version + 1}
+			docs[key] = doc
+			return doc, nil
+		},
+	})
+	mux.AddRoute(&Route{Path: NewPath("/doc/:key"), Method: "DELETE", Handler: func(precondition *Precondition, key string) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if doc, ok := docs[key]; !ok || !precondition.Match(doc.ETag()) {
+			return ErrPreconditionFailed
+		}
+		delete(docs, key)
+		return nil
+	}})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := &Client{Host: server.URL}
+
+	resp := client.NewRequest("GET").SetPath("/doc/a").Send()
+	stale := resp.ETag()
+	if stale != `"v1"` {
+		t.Fatalf("FAIL(get): unexpected etag: '%s'", stale)
+	}
+
+	put := client.NewRequest("PUT").SetPath("/doc/a").SetBody("b").IfMatch(stale).Send()
+	if err := put.GetBody(nil); err != nil {
+		t.Errorf("FAIL(put): unexpected error: %s", err)
+	}
+	current := put.ETag()
+	if current != `"v2"` {
+		t.Errorf("FAIL(put): unexpected etag: '%s'", current)
+	}
+
+	failResp(t, "put-stale", client.NewRequest("PUT").SetPath("/doc/a").SetBody("c").IfMatch(stale).Send(),
+		EndpointError, http.StatusPreconditionFailed)
+	failResp(t, "put-missing", client.NewRequest("PUT").SetPath("/doc/a").SetBody("c").Send(),
+		EndpointError, http.StatusPreconditionRequired)
+	failResp(t, "put-unknown", client.NewRequest("PUT").SetPath("/doc/b").SetBody("c").IfMatch("*").Send(),
+		EndpointError, http.StatusPreconditionFailed)
+
+	// Only one of the concurrent updates of the same version succeeds.
+	var wg sync.WaitGroup
+	updated := int32(0)
+	checked.Add(8)
+	atomic.StoreInt32(&racing, 1)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if client.NewRequest("PUT").SetPath("/doc/a").SetBody("c").IfMatch(stale, current).Send().GetBody(nil) == nil {
+				atomic.AddInt32(&updated, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	atomic.StoreInt32(&racing, 0)
+
+	if updated != 1 {
+		t.Errorf("FAIL(put-any): unexpected updates: %d", updated)
+	}
+
+	failResp(t, "delete-stale", client.NewRequest("DELETE").SetPath("/doc/a").IfMatch(current).Send(),
+		EndpointError, http.StatusPreconditionFailed)
+
+	if err := client.NewRequest("DELETE").SetPath("/doc/a").IfMatch("v3").Send().GetBody(nil); err != nil {
+		t.Errorf("FAIL(delete): unexpected error: %s", err)
+	}
+
+	if len(docs) != 0 {
+		t.Errorf("FAIL(delete): unexpected docs: %v", docs)
+	}
+}
+
+func TestParsePrecondition(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		exp    []string
+	}{
+		{"", nil},
+		{" , ", nil},
+		{"*", []string{"*"}},
+		{`"a", W/"b"`, []string{`"a"`, `W/"b"`}},
+		{`"a,b","c"`, []string{`"a,b"`, `"c"`}},
+		{`W/"a, b" , "c"`, []string{`W/"a, b"`, `"c"`}},
+	} {
+		precondition := parsePrecondition(test.header)
+
+		var etags []string
+		if precondition != nil {
+			etags = precondition.ETags
+		}
+
+		if !reflect.DeepEqual(etags, test.exp) {
+			t.Errorf("FAIL(%s): unexpected entity tags: %q != %q", test.header, etags, test.exp)
+		}
+	}
+
+	if !parsePrecondition(`"x", "a,b"`).Match("a,b") {
+		t.Errorf("FAIL(match): quoted comma doesn't match")
+	}
+}
+
+func TestMuxIdempotency(t *testing.T) {
+	var mutex sync.Mutex
+	orders := 0
+
+	started, release := make(chan struct{}), make(chan struct{})
+
+	mux := &Mux{}
+	mux.AddRoute(&Route{Path: NewPath("/orders"), Method: "POST", Idempotent: true, Handler: func(item string) int {
+		if item == "slow" {
+			close(started)
+			<-release
+		}
+
+		if item == "timeout" {
+			time.Sleep(200 * time.Millisecond)
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		orders++
+		return orders
+	}})
+
+	version := 1
+	mux.AddRoute(&Route{
+		Path:       NewPath("/version"),
+		Method:     "PUT",
+		Idempotent: true,
+		Version: func() string {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return fmt.Sprintf("v%d", version)
+		},
+		Handler: func(text string) int {
+			mutex.Lock()
+			defer mutex.Unlock()
+			version++
+			return version
+		},
+	})
+
+	// The first response is lost after the order is placed which forces the
+	// client to retry the request.
+	lost := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&lost, 1) == 1 {
+			mux.ServeHTTP(httptest.NewRecorder(), req)
+			http.Error(writer, "lost", http.StatusServiceUnavailable)
+			return
+		}
+		mux.ServeHTTP(writer, req)
+	}))
+	defer server.Close()
+
+	client := &Client{Host: server.URL}
+
+	order := func(title string, req *Request, exp int, expReplayed bool) {
+		var result int
+		resp := req.Send()
+		if err := resp.GetBody(&result); err != nil {
+			t.Errorf("FAIL(%s): unexpected error: %s", title, err)
+		} else if result != exp {
+			t.Errorf("FAIL(%s): unexpected result: %d != %d", title, result, exp)
+		}
+
+		if replayed := resp.Header.Get(ReplayedHeader) == "true"; replayed != expReplayed {
+			t.Errorf("FAIL(%s): unexpected replayed: %v", title, replayed)
+		}
+	}
+
+	retry := &RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, RetryNonIdempotent: true}
+	order("retry", client.NewRequest("POST").SetPath("/orders").SetBody("a").SetRetry(retry), 1, true)
+
+	order("key", client.NewRequest("POST").SetPath("/orders").SetBody("b").SetIdempotencyKey("k"), 2, false)
+	order("key-duplicate", client.NewRequest("POST").SetPath("/orders").SetBody("b").SetIdempotencyKey("k"), 2, true)
+	order("key-other", client.NewRequest("POST").SetPath("/orders").SetBody("b").SetIdempotencyKey("l"), 3, false)
+	order("no-key", client.NewRequest("POST").SetPath("/orders").SetBody("b"), 4, false)
+	failResp(t, "key-mismatch", client.NewRequest("POST").SetPath("/orders").SetBody("c").SetIdempotencyKey("k").Send(),
+		EndpointError, http.StatusUnprocessableEntity)
+
+	done := make(chan struct{})
+	go func() {
+		order("slow", client.NewRequest("POST").SetPath("/orders").SetBody("slow").SetIdempotencyKey("s"), 5, false)
+		close(done)
+	}()
+
+	<-started
+	failResp(t, "in-flight", client.NewRequest("POST").SetPath("/orders").SetBody("slow").SetIdempotencyKey("s").Send(),
+		EndpointError, http.StatusConflict)
+
+	close(release)
+	<-done
+
+	order("slow-duplicate", client.NewRequest("POST").SetPath("/orders").SetBody("slow").SetIdempotencyKey("s"), 5, true)
+
+	// A repeated update is replayed even though the version it was checked
+	// against is outdated.
+	order("version", client.NewRequest("PUT").SetPath("/version").SetBody("a").IfMatch("v1").SetIdempotencyKey("v"), 2, false)
+	order("version-duplicate", client.NewRequest("PUT").SetPath("/version").SetBody("a").IfMatch("v1").SetIdempotencyKey("v"), 2, true)
+	failResp(t, "version-stale", client.NewRequest("PUT").SetPath("/version").SetBody("a").IfMatch("v1").SetIdempotencyKey("w").Send(),
+		EndpointError, http.StatusPreconditionFailed)
+
+	// The first attempt times out while the order is being placed and the
+	// second one conflicts with it. The third one replays its response.
+	client = &Client{Host: server.URL, Client: &http.Client{Timeout: 100 * time.Millisecond}, Retry: retry}
+	var result int
+	resp := client.NewRequest("POST").SetPath("/orders").SetBody("timeout").Send()
+	if err := resp.GetBody(&result); err != nil || result != 6 {
+		t.Errorf("FAIL(timeout): unexpected result: %d %v", result, err)
+	} else if resp.Attempts != 3 || resp.Header.Get(ReplayedHeader) != "true" {
+		t.Errorf("FAIL(timeout): unexpected attempts: %d", resp.Attempts)
+	}
+}
+
+func TestMuxIdempotencyLease(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+
+	calls := int32(0)
+	mux := &Mux{}
+	mux.AddRoute(&Route{
+		Path:             NewPath("/orders"),
+		Method:           "POST",
+		Idempotent:       true,
+		IdempotencyLease: 10 * time.Millisecond,
+		Handler: func(item string) int {
+			n := atomic.AddInt32(&calls, 1)
+			if n == 1 {
+				close(started)
+				<-release
+			}
+			return int(n)
+		},
+	})
+
+	send := func() *httptest.ResponseRecorder {
+		httpReq := httptest.NewRequest("POST", "/orders", strings.NewReader(`"item"`))
+		httpReq.Header.Set("Content-Type", "application/json")
+		httpReq.Header.Set(IdempotencyKeyHeader, "key")
+
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httpReq)
+		return recorder
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		send()
+	}()
+	<-started
+
+	if resp := send(); resp.Code != http.StatusConflict {
+		t.Errorf("FAIL(in-flight): unexpected response: %d", resp.Code)
+	}
+
+	// The request is served again once the lease of the stuck request expired.
+	time.Sleep(20 * time.Millisecond)
+	if resp := send(); resp.Code != http.StatusOK || resp.Body.String() != "2" {
+		t.Errorf("FAIL(expired): unexpected response: %d %s", resp.Code, resp.Body.String())
+	}
+
+	close(release)
+	<-done
+}
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	store := &MemoryIdempotencyStore{MaxEntries: 2}
+
+	store.Reserve("a", time.Hour)
+	store.Complete("a", &StoredResponse{Code: http.StatusOK}, time.Hour)
+	store.Reserve("b", time.Hour)
+
+	// The completed key is evicted to make room for the new key.
+	if _, reserved, err := store.Reserve("c", time.Hour); err != nil || !reserved {
+		t.Errorf("FAIL(evict): unexpected reservation: %v %v", reserved, err)
+	}
+	if resp, reserved, _ := store.Reserve("a", time.Hour); resp != nil || reserved {
+		t.Errorf("FAIL(evict): unexpected key: %v %v", resp, reserved)
+	}
+
+	// All the keys are in flight.
+	if _, _, err := store.Reserve("d", time.Hour); err == nil {
+		t.Errorf("FAIL(full): expected error")
+	}
+	if n := store.Len(); n != 2 {
+		t.Errorf("FAIL(full): unexpected length: %d", n)
+	}
+}
+
+func TestMuxThrottle(t *testing.T) {
+	var mutex sync.Mutex
+	var errorTypes []ErrorType
+	started, release := make(chan struct{}), make(chan struct{})
+
+	mux := &Mux{
+		Throttle: &Throttle{Rate: 0.01, Burst: 2, Key: HeaderKey("X-Caller")},
+		ErrorFunc: func(errType ErrorType, err error) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			errorTypes = append(errorTypes, errType)
+			return err
+		},
+	}
+
+	slow := &Throttle{MaxInFlight: 1}
+	mux.AddRoute(&Route{Path: NewPath("/fast"), Method: "GET", Handler: func() string { return "fast" }})
+	mux.AddRoute(&Route{Path: NewPath("/slow"), Method: "GET", Throttle: slow, Handler: func() string {
+		started <- struct{}{}
+		<-release
+		return "slow"
+	}})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := &Client{Host: server.URL}
+
+	get := func(caller, path string) *Response {
+		return client.NewRequest("GET").SetPath(path).AddHeader("X-Caller", caller).Send()
+	}
+
+	ok := func(title string, resp *Response) {
+		if err := resp.GetBody(nil); err != nil {
+			t.Errorf("FAIL(%s): unexpected error: %s", title, err)
+		}
+	}
+
+	rejected := func(title string, resp *Response, code int, retryAfter string) {
+		failResp(t, title, resp, EndpointError, code)
+		if header := resp.Header.Get("Retry-After"); header != retryAfter {
+			t.Errorf("FAIL(%s): unexpected retry after: '%s' != '%s'", title, header, retryAfter)
+		}
+	}
+
+	ok("burst-1", get("a", "/fast"))
+	ok("burst-2", get("a", "/fast"))
+	rejected("rate", get("a", "/fast"), http.StatusTooManyRequests, "100")
+	ok("other-caller", get("b", "/fast"))
+
+	done := make(chan struct{})
+	go func() {
+		ok("in-flight", get("c", "/slow"))
+		close(done)
+	}()
+
+	<-started
+	if stats := slow.Stats(); stats.InFlight != 1 || stats.MaxInFlight != 1 {
+		t.Errorf("FAIL(stats): unexpected stats: %+v", stats)
+	}
+
+	rejected("overloaded", get("d", "/slow"), http.StatusServiceUnavailable, "1")
+
+	close(release)
+	<-done
+
+	// The token consumed by the overloaded request was refunded.
+	ok("refund-1", get("d", "/fast"))
+	ok("refund-2", get("d", "/fast"))
+
+	// The slot of a request is released once its response was written.
+	for deadline := time.Now().Add(time.Second); slow.Stats().InFlight != 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+
+	if stats := slow.Stats(); stats.InFlight != 0 || stats.Overloaded != 1 {
+		t.Errorf("FAIL(stats-slow): unexpected stats: %+v", stats)
+	}
+
+	if stats := mux.Throttle.Stats(); stats.InFlight != 0 || stats.Limited != 1 || stats.Callers != 4 {
+		t.Errorf("FAIL(stats-mux): unexpected stats: %+v", stats)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(errorTypes) != 2 || errorTypes[0] != TooManyRequests || errorTypes[1] != Overloaded {
+		t.Errorf("FAIL(error-func): unexpected error types: %v", errorTypes)
+	}
+}
+
+func TestMuxThrottlePrincipal(t *testing.T) {
+	mux := &Mux{
+		Authenticator: BearerAuthenticator(func(token string) (*Principal, error) {
+			return &Principal{Subject: token}, nil
+		}),
+	}
+	mux.AddRoute(&Route{
+		Path:     NewPath("/user"),
+		Method:   "GET",
+		Throttle: &Throttle{Rate: 0.01, Key: PrincipalKey, Authenticated: true},
+		Handler:  func(principal *Principal) string { return principal.Subject },
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := &Client{Host: server.URL}
+
+	get := func(token string) *Response {
+		return client.NewRequest("GET").SetPath("/user").AddHeader("Authorization", "Bearer "+token).Send()
+	}
+
+	// Callers sharing an IP address are throttled separately.
+	for _, token := range []string{"a", "b"} {
+		var subject string
+		if err := get(token).GetBody(&subject); err != nil || subject != token {
+			t.Errorf("FAIL(%s): unexpected result: '%s' %v", token, subject, err)
+		}
+	}
+
+	failResp(t, "rate", get("a"), EndpointError, http.StatusTooManyRequests)
+}
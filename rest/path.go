@@ -4,6 +4,8 @@ package rest
 
 import (
 	"bytes"
+	"fmt"
+	"net/url"
 	"strings"
 )
 
@@ -85,3 +87,27 @@ func (path Path) String() string {
 
 	return buffer.String()
 }
+
+// Format builds a concrete path by replacing each argument of the path with
+// the string representation of the matching argument in args. Arguments are
+// escaped so that they always map to a single item of the path. An error is
+// returned if the number of arguments doesn't match the path.
+func (path Path) Format(args ...interface{}) (string, error) {
+	if n := path.NumArgs(); n != len(args) {
+		return "", fmt.Errorf("argument count mismatch for path '%s': %d != %d", path, len(args), n)
+	}
+
+	items := make([]string, 0, len(path))
+
+	i := 0
+	for _, item := range path {
+		if item.IsArg {
+			items = append(items, url.PathEscape(fmt.Sprint(args[i])))
+			i++
+		} else {
+			items = append(items, item.Name)
+		}
+	}
+
+	return "/" + strings.Join(items, "/"), nil
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// ErrPreconditionFailed can be returned by handlers which received a
+// Precondition that doesn't match the current version of their resource. The
+// Mux then responds with a 412 status code.
+var ErrPreconditionFailed error = &CodedError{http.StatusPreconditionFailed, errors.New("precondition failed")}
+
+// Precondition holds the entity tags of the If-Match header of a request.
+// Handlers can receive the precondition by declaring a *Precondition as their
+// first argument or, if they receive a *Principal, as their second argument.
+// The precondition is nil if the request has no If-Match header.
+type Precondition struct {
+
+	// ETags is the list of entity tags of the If-Match header. A single "*"
+	// matches any existing version of the resource.
+	ETags []string
+}
+
+var preconditionType = reflect.TypeOf((*Precondition)(nil))
+
+// parsePrecondition parses the given If-Match header. Returns nil if the
+// header is empty.
+func parsePrecondition(header string) *Precondition {
+	etags := splitETags(header)
+	if len(etags) == 0 {
+		return nil
+	}
+	return &Precondition{ETags: etags}
+}
+
+// Match indicates whether the given entity tag of the current version of a
+// resource satisfies the precondition using the strong comparison. Weak
+// entity tags never match. An empty entity tag indicates that the resource
+// doesn't exist. The entity tags of the compressed responses of the resource
+// also match. A nil precondition matches everything.
+func (precondition *Precondition) Match(etag string) bool {
+	if precondition == nil {
+		return true
+	}
+
+	etag = quoteETag(etag)
+	if len(etag) == 0 || strings.HasPrefix(etag, "W/") {
+		return false
+	}
+
+	for _, tag := range precondition.ETags {
+		if tag == "*" || tag == etag || tag == encodeETag(etag, "gzip") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// initVersion validates the Version function of the route.
+func (route *Route) initVersion() {
+	if route.Version == nil {
+		return
+	}
+
+	route.versionFunc = reflect.ValueOf(route.Version)
+	typ := route.versionFunc.Type()
+
+	if typ.Kind() != reflect.Func {
+		log.Panicf("invalid version type for route %s: got '%s' expected '%s'",
+			route, typ.Kind(), reflect.Func)
+	}
+
+	if typ.NumIn() != route.Path.NumArgs() {
+		log.Panicf("invalid number of version arguments for route %s: %d != %d",
+			route, typ.NumIn(), route.Path.NumArgs())
+	}
+
+	errorType := reflect.TypeOf((*error)(nil)).Elem()
+	stringType := reflect.TypeOf("")
+
+	if typ.NumOut() < 1 || typ.NumOut() > 2 || typ.Out(0) != stringType ||
+		(typ.NumOut() == 2 && typ.Out(1) != errorType) {
+		log.Panicf("invalid version return values for route %s: expected (string) or (string, error)", route)
+	}
+}
+
+// version returns the entity tag of the current version of the resource
+// identified by the given path arguments using the Version function of the
+// route.
+func (route *Route) version(args []string) (string, *Error) {
+	typ := route.versionFunc.Type()
+	in := make([]reflect.Value, typ.NumIn())
+
+	for i := range in {
+		arg := reflect.New(typ.In(i)).Elem()
+		if err := route.parseArg(args[i], arg); err != nil {
+			return "", &Error{UnmarshalError, err}
+		}
+		in[i] = arg
+	}
+
+	out := route.versionFunc.Call(in)
+
+	if len(out) == 2 && !out[1].IsNil() {
+		return "", &Error{HandlerError, out[1].Interface().(error)}
+	}
+
+	return out[0].String(), nil
+}
+
+// precondition extracts the If-Match header of the request and checks it
+// against the Version function of the route, if any. Returns false if the
+// request was rejected in which case the error was already written to the
+// response.
+func (mux *Mux) precondition(writer http.ResponseWriter, httpReq *http.Request, route *Route, args []string) (*Precondition, bool) {
+	precondition := parsePrecondition(httpReq.Header.Get("If-Match"))
+
+	if precondition == nil {
+		if route.RequireIfMatch {
+			err := errors.New("missing If-Match header")
+			mux.respondError(writer, PreconditionRequired, http.StatusPreconditionRequired, err)
+			return nil, false
+		}
+		return nil, true
+	}
+
+	if route.Version == nil {
+		return precondition, true
+	}
+
+	etag, restError := route.version(args)
+	if restError != nil {
+		mux.respondError(writer, restError.Type, http.StatusBadRequest, restError.Sub)
+		return nil, false
+	}
+
+	if !precondition.Match(etag) {
+		err := fmt.Errorf("current version %s doesn't match %s", quoteETag(etag), strings.Join(precondition.ETags, ", "))
+		if len(etag) == 0 {
+			err = errors.New("resource doesn't exist")
+		}
+		mux.respondError(writer, PreconditionFailed, http.StatusPreconditionFailed, err)
+		return nil, false
+	}
+
+	return precondition, true
+}
+
+// ETag returns the entity tag of the response or an empty string if the
+// response doesn't have one. It can be passed to Request.IfMatch to
+// conditionally update the resource.
+func (resp *Response) ETag() string {
+	if resp.Header == nil {
+		return ""
+	}
+	return resp.Header.Get("ETag")
+}
+
+// IfMatch makes the request conditional on the current version of the
+// targeted resource matching one of the given entity tags, typically
+// captured from a previous response via Response.ETag. Empty entity tags are
+// ignored.
+func (req *Request) IfMatch(etags ...string) *Request {
+	var tags []string
+	for _, etag := range etags {
+		if etag = quoteETag(etag); len(etag) > 0 {
+			tags = append(tags, etag)
+		}
+	}
+
+	if len(tags) > 0 {
+		if req.Header == nil {
+			req.Header = make(http.Header)
+		}
+		req.Header.Set("If-Match", strings.Join(tags, ", "))
+	}
+
+	return req
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate at which a Client sends requests using a token
+// bucket: tokens are added at Rate per second up to Burst and each attempt of a
+// request consumes one token. Attempts wait for a token unless Reject is set or
+// the wait would exceed MaxWait or the deadline of the request's context, in
+// which case they fail with a RateLimited error.
+//
+// A response with a 429 status code and a Retry-After header pauses the
+// limiter until the requested time and a 429 without Retry-After drains the
+// bucket such that requests no longer burst.
+type RateLimiter struct {
+
+	// Rate is the number of requests per second. If not set then the rate is
+	// only limited by the pauses requested by the remote hosts.
+	Rate float64
+
+	// Burst is the maximum number of requests that can be sent at once.
+	// Defaults to 1.
+	Burst int
+
+	// MaxWait is the maximum time an attempt waits for a token. If not set
+	// then attempts wait until a token is available or until their context
+	// is done.
+	MaxWait time.Duration
+
+	// Reject fails attempts immediately if no token is available instead of
+	// waiting for one.
+	Reject bool
+
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	pause  time.Time
+}
+
+func (limiter *RateLimiter) burst() float64 {
+	if limiter.Burst > 0 {
+		return float64(limiter.Burst)
+	}
+	return 1
+}
+
+func (limiter *RateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	if limiter.buckets == nil {
+		limiter.buckets = make(map[string]*tokenBucket)
+	}
+	limiter.sweep(now)
+
+	b, ok := limiter.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: limiter.burst(), last: now}
+		limiter.buckets[key] = b
+	}
+
+	return b
+}
+
+// sweep removes the idle buckets at most once a minute. Buckets which are full
+// and not paused are equivalent to missing buckets.
+func (limiter *RateLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.swept) < time.Minute {
+		return
+	}
+	limiter.swept = now
+
+	for key, b := range limiter.buckets {
+		full := limiter.Rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*limiter.Rate >= limiter.burst()
+		if full && !b.pause.After(now) {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// reserve takes a token from the bucket of the given key and returns the delay
+// after which the token is available.
+func (limiter *RateLimiter) reserve(key string, now time.Time) time.Duration {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	b := limiter.bucket(key, now)
+
+	var delay time.Duration
+
+	if limiter.Rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * limiter.Rate
+		if burst := limiter.burst(); b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+
+		if b.tokens--; b.tokens < 0 {
+			delay = time.Duration(-b.tokens / limiter.Rate * float64(time.Second))
+		}
+	}
+
+	if pause := b.pause.Sub(now); pause > delay {
+		delay = pause
+	}
+
+	return delay
+}
+
+// cancel returns a token taken by reserve which wasn't used.
+func (limiter *RateLimiter) cancel(key string) {
+	if limiter.Rate <= 0 {
+		return
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.bucket(key, time.Now()).tokens++
+}
+
+// wait blocks until a token is available for the given key.
+func (limiter *RateLimiter) wait(ctx context.Context, key string) *Error {
+	now := time.Now()
+
+	delay := limiter.reserve(key, now)
+	if delay <= 0 {
+		return nil
+	}
+
+	if limiter.Reject || limiter.MaxWait > 0 && delay > limiter.MaxWait {
+		limiter.cancel(key)
+		return ErrorFmt(RateLimited, "rate limit exceeded: next request allowed in %s", delay)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && now.Add(delay).After(deadline) {
+		limiter.cancel(key)
+		return ErrorFmt(RateLimited, "rate limit exceeded: next request allowed after the deadline")
+	}
+
+	if err := sleep(ctx, delay); err != nil {
+		limiter.cancel(key)
+		return err
+	}
+
+	return nil
+}
+
+// record slows down the bucket of the given key if the response indicates that
+// the remote host is receiving too many requests.
+func (limiter *RateLimiter) record(key string, resp *Response) {
+	if resp.Code != http.StatusTooManyRequests {
+		return
+	}
+
+	now := time.Now()
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	b := limiter.bucket(key, now)
+
+	if retryAfter, ok := resp.RetryAfter(); ok {
+		if pause := now.Add(retryAfter); pause.After(b.pause) {
+			b.pause = pause
+		}
+	}
+
+	if b.tokens > 0 {
+		b.tokens = 0
+	}
+}
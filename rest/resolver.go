@@ -0,0 +1,358 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultResolveInterval is the default interval at which the polling
+	// resolvers refresh their set of hosts.
+	DefaultResolveInterval = 30 * time.Second
+
+	// DefaultResolveTimeout is the default timeout of the DNS lookups of a
+	// DNSResolver.
+	DefaultResolveTimeout = 5 * time.Second
+)
+
+// Resolver supplies the set of hosts to which a Client sends its requests.
+// Hosts is called for every attempt of a request and must therefore be cheap
+// and safe to call concurrently.
+type Resolver interface {
+
+	// Hosts returns the current set of host addresses.
+	Hosts() []string
+}
+
+// StaticResolver is a Resolver for a fixed set of hosts.
+type StaticResolver []string
+
+// Hosts returns the hosts of the resolver.
+func (resolver StaticResolver) Hosts() []string {
+	return resolver
+}
+
+// minResolveBackoff is the delay after which a failed refresh is retried. It
+// doubles with each consecutive failure up to the polling interval.
+var minResolveBackoff = 100 * time.Millisecond
+
+// poller caches a set of hosts which is refreshed in the background once it
+// becomes older than the polling interval. The previous set is kept if a
+// refresh fails and failed refreshes are retried after a backoff. Until a
+// non-empty set is found, refreshes are done synchronously.
+type poller struct {
+	initial    sync.Once
+	mutex      sync.Mutex
+	hosts      []string
+	err        error
+	updated    time.Time
+	failed     time.Time
+	failures   int
+	refreshing bool
+}
+
+func (poller *poller) get(interval time.Duration, refresh func() ([]string, error)) []string {
+	if interval == 0 {
+		interval = DefaultResolveInterval
+	}
+
+	// The first refresh is done synchronously so that the first requests
+	// don't fail while the resolver warms up. Concurrent callers wait for it
+	// without holding the lock.
+	poller.initial.Do(func() {
+		poller.refreshing = true
+		poller.refresh(refresh)
+	})
+
+	poller.mutex.Lock()
+
+	if poller.refreshing || !poller.due(interval) {
+		defer poller.mutex.Unlock()
+		return poller.hosts
+	}
+
+	poller.refreshing = true
+
+	if len(poller.hosts) > 0 {
+		defer poller.mutex.Unlock()
+		go poller.refresh(refresh)
+		return poller.hosts
+	}
+
+	poller.mutex.Unlock()
+	poller.refresh(refresh)
+
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+
+	return poller.hosts
+}
+
+// due indicates whether the hosts should be refreshed.
+func (poller *poller) due(interval time.Duration) bool {
+	if poller.failures == 0 {
+		return time.Since(poller.updated) >= interval
+	}
+
+	backoff := minResolveBackoff
+	for i := 1; i < poller.failures && backoff < interval; i++ {
+		backoff *= 2
+	}
+	if backoff > interval {
+		backoff = interval
+	}
+
+	return time.Since(poller.failed) >= backoff
+}
+
+// refresh calls the given refresh function and records its result.
+func (poller *poller) refresh(refresh func() ([]string, error)) {
+	hosts, err := refresh()
+
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+
+	poller.update(hosts, err)
+	poller.refreshing = false
+}
+
+func (poller *poller) update(hosts []string, err error) {
+	if err == nil && len(hosts) == 0 && len(poller.hosts) == 0 {
+		err = errors.New("no hosts found")
+	}
+
+	if poller.err = err; err != nil {
+		poller.failed = time.Now()
+		poller.failures++
+		return
+	}
+
+	poller.hosts, poller.updated, poller.failures = hosts, time.Now(), 0
+}
+
+func (poller *poller) lastError() error {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+
+	return poller.err
+}
+
+// DNSResolver is a Resolver which periodically looks up the hosts of a domain
+// name. If Service is set then SRV records are used to find both the targets
+// and the ports of the hosts, otherwise A and AAAA records are used along with
+// Port. The hosts of SRV records are ordered by priority and then randomly
+// according to their weight as described in RFC 2782.
+type DNSResolver struct {
+
+	// Name is the domain name to look up.
+	Name string
+
+	// Service and Proto are used to look up the SRV records of the form
+	// _service._proto.name. Proto defaults to tcp.
+	Service string
+	Proto   string
+
+	// Port is the port of the hosts when looking up A and AAAA records.
+	Port int
+
+	// Scheme is prepended to the addresses of the hosts. Defaults to http.
+	Scheme string
+
+	// Interval is the polling interval. Defaults to DefaultResolveInterval.
+	Interval time.Duration
+
+	// Timeout is the timeout of each lookup. Defaults to
+	// DefaultResolveTimeout.
+	Timeout time.Duration
+
+	// Resolver is used to make the DNS queries. Defaults to net.DefaultResolver.
+	Resolver *net.Resolver
+
+	poller poller
+}
+
+// Hosts returns the hosts found during the last lookup.
+func (resolver *DNSResolver) Hosts() []string {
+	return resolver.poller.get(resolver.Interval, resolver.lookup)
+}
+
+// Err returns the error of the last lookup, if any.
+func (resolver *DNSResolver) Err() error {
+	return resolver.poller.lastError()
+}
+
+func (resolver *DNSResolver) lookup() ([]string, error) {
+	dns := resolver.Resolver
+	if dns == nil {
+		dns = net.DefaultResolver
+	}
+
+	scheme := resolver.Scheme
+	if len(scheme) == 0 {
+		scheme = "http"
+	}
+
+	timeout := resolver.Timeout
+	if timeout == 0 {
+		timeout = DefaultResolveTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var hosts []string
+
+	if len(resolver.Service) > 0 {
+		proto := resolver.Proto
+		if len(proto) == 0 {
+			proto = "tcp"
+		}
+
+		_, records, err := dns.LookupSRV(ctx, resolver.Service, proto, resolver.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range orderSRV(records) {
+			host := strings.TrimSuffix(record.Target, ".")
+			hosts = append(hosts, scheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+		}
+
+	} else {
+		addrs, err := dns.LookupHost(ctx, resolver.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range addrs {
+			hosts = append(hosts, scheme+"://"+net.JoinHostPort(addr, strconv.Itoa(resolver.Port)))
+		}
+		sort.Strings(hosts)
+	}
+
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no hosts found for '%s'", resolver.Name)
+	}
+
+	return hosts, nil
+}
+
+// orderSRV orders the given records by priority and then randomly according
+// to their weight within each priority as described in RFC 2782.
+func orderSRV(records []*net.SRV) []*net.SRV {
+	sorted := append([]*net.SRV(nil), records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	ordered := make([]*net.SRV, 0, len(sorted))
+
+	for start := 0; start < len(sorted); {
+		end := start
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			end++
+		}
+
+		group := sorted[start:end]
+
+		// Records with a weight of 0 are placed first such that they have
+		// a small chance of being selected.
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].Weight == 0 && group[j].Weight > 0
+		})
+
+		for len(group) > 0 {
+			total := 0
+			for _, record := range group {
+				total += int(record.Weight)
+			}
+
+			pick, sum := 0, 0
+			if threshold := rand.Intn(total + 1); total > 0 {
+				for pick = range group {
+					if sum += int(group[pick].Weight); sum >= threshold {
+						break
+					}
+				}
+			}
+
+			ordered = append(ordered, group[pick])
+			group = append(group[:pick], group[pick+1:]...)
+		}
+
+		start = end
+	}
+
+	return ordered
+}
+
+// FileResolver is a Resolver which reads the hosts from a file containing one
+// address per line. Empty lines and lines starting with '#' are ignored. The
+// file is re-read whenever its modification time changes.
+type FileResolver struct {
+
+	// Path is the path of the file containing the hosts.
+	Path string
+
+	// Interval is the interval at which the modification time of the file is
+	// checked. Defaults to DefaultResolveInterval.
+	Interval time.Duration
+
+	poller  poller
+	modTime time.Time
+	hosts   []string
+}
+
+// Hosts returns the hosts found in the file during the last read.
+func (resolver *FileResolver) Hosts() []string {
+	return resolver.poller.get(resolver.Interval, resolver.read)
+}
+
+// Err returns the error of the last read, if any.
+func (resolver *FileResolver) Err() error {
+	return resolver.poller.lastError()
+}
+
+// read is only called by the poller which guarantees that there's never more
+// than one concurrent call.
+func (resolver *FileResolver) read() ([]string, error) {
+	info, err := os.Stat(resolver.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.ModTime().Equal(resolver.modTime) {
+		return resolver.hosts, nil
+	}
+
+	data, err := ioutil.ReadFile(resolver.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); len(line) > 0 && line[0] != '#' {
+			hosts = append(hosts, line)
+		}
+	}
+
+	resolver.modTime = info.ModTime()
+	resolver.hosts = hosts
+	return hosts, nil
+}
@@ -0,0 +1,221 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package restgen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const restPkgPath = "github.com/datacratic/gorest/rest"
+
+// goImports tracks the packages that need to be imported by the generated
+// code and the name under which they're imported.
+type goImports struct {
+	self    string
+	aliases map[string]string
+	used    map[string]bool
+}
+
+func newGoImports(self string) *goImports {
+	return &goImports{
+		self:    self,
+		aliases: map[string]string{restPkgPath: "rest"},
+		used:    map[string]bool{"rest": true, "http": true},
+	}
+}
+
+func (imports *goImports) add(pkgPath string) string {
+	if alias, ok := imports.aliases[pkgPath]; ok {
+		return alias
+	}
+
+	base := argName(path.Base(pkgPath))
+	alias := base
+	for i := 2; imports.used[alias]; i++ {
+		alias = fmt.Sprintf("%s%d", base, i)
+	}
+
+	imports.aliases[pkgPath] = alias
+	imports.used[alias] = true
+	return alias
+}
+
+func (imports *goImports) typeName(t reflect.Type) (string, error) {
+	if len(t.Name()) > 0 {
+		if len(t.PkgPath()) == 0 || t.PkgPath() == imports.self {
+			return t.Name(), nil
+		}
+
+		if !token.IsExported(t.Name()) {
+			return "", fmt.Errorf("unexported type '%s' can't be referenced", t)
+		}
+
+		return imports.add(t.PkgPath()) + "." + t.Name(), nil
+	}
+
+	switch t.Kind() {
+
+	case reflect.Ptr:
+		elem, err := imports.typeName(t.Elem())
+		return "*" + elem, err
+
+	case reflect.Slice:
+		elem, err := imports.typeName(t.Elem())
+		return "[]" + elem, err
+
+	case reflect.Array:
+		elem, err := imports.typeName(t.Elem())
+		return fmt.Sprintf("[%d]%s", t.Len(), elem), err
+
+	case reflect.Map:
+		key, err := imports.typeName(t.Key())
+		if err != nil {
+			return "", err
+		}
+		elem, err := imports.typeName(t.Elem())
+		return fmt.Sprintf("map[%s]%s", key, elem), err
+
+	case reflect.Interface:
+		if t.NumMethod() == 0 {
+			return "interface{}", nil
+		}
+
+	case reflect.Struct:
+		var fields []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+
+			fieldType, err := imports.typeName(field.Type)
+			if err != nil {
+				return "", err
+			}
+
+			str := field.Name + " " + fieldType
+			if field.Anonymous {
+				str = fieldType
+			}
+			if len(field.Tag) > 0 {
+				str += " " + strconv.Quote(string(field.Tag))
+			}
+			fields = append(fields, str)
+		}
+		return "struct{ " + strings.Join(fields, "; ") + " }", nil
+	}
+
+	return "", fmt.Errorf("unsupported type '%s'", t)
+}
+
+// Go writes the source of a typed Go client for the routes to the given
+// writer. The generated client embeds a rest.Client and provides one method
+// per route.
+func (gen *Generator) Go(writer io.Writer) error {
+	imports := newGoImports(gen.PkgPath)
+	client := exported(gen.Name) + "Client"
+
+	var body bytes.Buffer
+	var paths []string
+	needHTTP := false
+
+	for _, m := range gen.methods() {
+		pathVar := argName(client + m.Name + "Path")
+		paths = append(paths, fmt.Sprintf("%s = rest.NewPath(%q)", pathVar, m.Route.Path.String()))
+
+		var params, args []string
+		for _, arg := range m.Args {
+			typ, err := imports.typeName(arg.Type)
+			if err != nil {
+				return fmt.Errorf("invalid argument '%s' for route %s: %s", arg.Name, m.Route, err)
+			}
+
+			params = append(params, arg.Name+" "+typ)
+			args = append(args, arg.Name)
+		}
+
+		if m.Route.IsMultipart() {
+			params = append(params, "body *rest.Multipart")
+
+		} else if m.Body != nil {
+			typ, err := imports.typeName(m.Body)
+			if err != nil {
+				return fmt.Errorf("invalid body for route %s: %s", m.Route, err)
+			}
+			params = append(params, "body "+typ)
+		}
+
+		results := "err *rest.Error"
+		if m.Return != nil {
+			typ, err := imports.typeName(m.Return)
+			if err != nil {
+				return fmt.Errorf("invalid return for route %s: %s", m.Route, err)
+			}
+			results = "result " + typ + ", " + results
+		}
+
+		fmt.Fprintf(&body, "\n// %s sends a %s request to %s.\n", m.Name, m.Route.Method, m.Route.Path)
+		fmt.Fprintf(&body, "func (client *%s) %s(%s) (%s) {\n", client, m.Name, strings.Join(params, ", "), results)
+		fmt.Fprintf(&body, "resp := client.NewRequest(%q).\n", m.Route.Method)
+		fmt.Fprintf(&body, "SetPathArgs(%s)", strings.Join(append([]string{pathVar}, args...), ", "))
+		if m.Route.IsMultipart() {
+			fmt.Fprintf(&body, ".\nSetMultipart(body)")
+		} else if m.Body != nil {
+			fmt.Fprintf(&body, ".\nSetBody(body)")
+		}
+		fmt.Fprintf(&body, ".\nSend()\n\n")
+
+		if m.Return != nil {
+			needHTTP = true
+			fmt.Fprintf(&body, "if resp.Error == nil && resp.Code == http.StatusNoContent {\nreturn\n}\n\n")
+			fmt.Fprintf(&body, "err = resp.GetBody(&result)\nreturn\n}\n")
+		} else {
+			fmt.Fprintf(&body, "err = resp.GetBody(nil)\nreturn\n}\n")
+		}
+	}
+
+	var src bytes.Buffer
+	fmt.Fprintf(&src, "// Code generated by restgen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&src, "package %s\n\n", gen.Package)
+
+	var pkgs []string
+	for pkgPath, alias := range imports.aliases {
+		if alias == path.Base(pkgPath) {
+			pkgs = append(pkgs, strconv.Quote(pkgPath))
+		} else {
+			pkgs = append(pkgs, alias+" "+strconv.Quote(pkgPath))
+		}
+	}
+	sort.Strings(pkgs)
+
+	fmt.Fprintf(&src, "import (\n%s\n", strings.Join(pkgs, "\n"))
+	if needHTTP {
+		fmt.Fprintf(&src, "\n\"net/http\"\n")
+	}
+	fmt.Fprintf(&src, ")\n\n")
+
+	if len(paths) > 0 {
+		fmt.Fprintf(&src, "var (\n%s\n)\n\n", strings.Join(paths, "\n"))
+	}
+
+	fmt.Fprintf(&src, "// %s is a typed REST client for the routes of %s.\n", client, gen.Name)
+	fmt.Fprintf(&src, "type %s struct {\n*rest.Client\n}\n\n", client)
+	fmt.Fprintf(&src, "// New%s creates a new %s which sends its requests to the\n// given host.\n", client, client)
+	fmt.Fprintf(&src, "func New%s(host string) *%s {\n", client, client)
+	fmt.Fprintf(&src, "return &%s{&rest.Client{Host: host}}\n}\n", client)
+	src.Write(body.Bytes())
+
+	formatted, err := format.Source(src.Bytes())
+	if err != nil {
+		return fmt.Errorf("unable to format generated code: %s", err)
+	}
+
+	_, err = writer.Write(formatted)
+	return err
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+/*
+Package restgen generates typed clients from the routes of a REST service.
+
+The generator works on the rest.Routes of a service and uses the signatures of
+the route handlers to derive the arguments and the return values of each client
+method. The restgen command wraps this package and is intended to be invoked
+via go generate:
+
+	//go:generate go run github.com/datacratic/gorest/cmd/restgen -type=PingService
+*/
+package restgen
+
+import (
+	"github.com/datacratic/gorest/rest"
+
+	"fmt"
+	"go/token"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Generator emits client code for a set of REST routes.
+type Generator struct {
+
+	// Name is the name of the service which is used to name the generated
+	// client.
+	Name string
+
+	// Package is the name of the package of the generated code.
+	Package string
+
+	// PkgPath is the import path of the package of the generated code. Types
+	// defined in this package will not be qualified in the generated code.
+	PkgPath string
+
+	// Routes is the list of routes for which a client method is generated.
+	Routes rest.Routes
+}
+
+type arg struct {
+	Name string
+	Type reflect.Type
+}
+
+type method struct {
+	Name   string
+	Route  *rest.Route
+	Args   []arg
+	Body   reflect.Type
+	Return reflect.Type
+}
+
+// reserved contains the identifiers used by the generated code which can't be
+// used as argument names.
+var reserved = map[string]bool{
+	"body":   true,
+	"client": true,
+	"err":    true,
+	"resp":   true,
+	"result": true,
+	"rest":   true,
+	"http":   true,
+}
+
+var anonymousFunc = regexp.MustCompile(`^func[0-9]+$`)
+
+func (gen *Generator) methods() []*method {
+	var methods []*method
+	count := make(map[string]int)
+
+	for _, route := range gen.Routes {
+		m := &method{
+			Name:   handlerMethodName(route),
+			Route:  route,
+			Body:   route.BodyType(),
+			Return: route.ReturnType(),
+		}
+
+		names := make(map[string]bool)
+		types := route.ArgTypes()
+		i := 0
+
+		for _, item := range route.Path {
+			if !item.IsArg {
+				continue
+			}
+
+			name := argName(item.Name)
+			for names[name] {
+				name += "_"
+			}
+			names[name] = true
+
+			m.Args = append(m.Args, arg{name, types[i]})
+			i++
+		}
+
+		count[m.Name]++
+		methods = append(methods, m)
+	}
+
+	// Handlers can be shared between multiple routes in which case we fallback
+	// to a name derived from the route itself.
+	taken := make(map[string]bool)
+	for _, m := range methods {
+		if count[m.Name] > 1 {
+			m.Name = pathMethodName(m.Route)
+		}
+
+		name := m.Name
+		for i := 2; taken[name]; i++ {
+			name = fmt.Sprintf("%s%d", m.Name, i)
+		}
+		m.Name = name
+		taken[name] = true
+	}
+
+	return methods
+}
+
+func handlerMethodName(route *rest.Route) string {
+	if len(route.Name) > 0 {
+		return exported(route.Name)
+	}
+
+	name := strings.TrimSuffix(route.HandlerName(), "-fm")
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+
+	if len(name) == 0 || anonymousFunc.MatchString(name) || !token.IsIdentifier(name) {
+		return pathMethodName(route)
+	}
+
+	return exported(name)
+}
+
+func pathMethodName(route *rest.Route) string {
+	name := exported(strings.ToLower(route.Method))
+	for _, item := range route.Path {
+		name += exported(item.Name)
+	}
+	return name
+}
+
+// words splits the given string into its alpha-numeric components.
+func words(str string) []string {
+	return strings.FieldsFunc(str, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// upperFirst returns the given string with its first letter in upper case.
+func upperFirst(str string) string {
+	if len(str) == 0 {
+		return str
+	}
+
+	r, n := utf8.DecodeRuneInString(str)
+	return string(unicode.ToUpper(r)) + str[n:]
+}
+
+// lowerFirst returns the given string with its first letter in lower case.
+func lowerFirst(str string) string {
+	if len(str) == 0 {
+		return str
+	}
+
+	r, n := utf8.DecodeRuneInString(str)
+	return string(unicode.ToLower(r)) + str[n:]
+}
+
+// exported returns the given string as an exported identifier. Names whose
+// first letter has no upper case are prefixed with X.
+func exported(str string) string {
+	var name string
+	for _, word := range words(str) {
+		name += upperFirst(word)
+	}
+
+	if r, _ := utf8.DecodeRuneInString(name); !unicode.IsUpper(r) {
+		name = "X" + name
+	}
+	return name
+}
+
+func argName(str string) string {
+	name := lowerFirst(exported(str))
+
+	if token.IsKeyword(name) || reserved[name] {
+		name += "Arg"
+	}
+	return name
+}
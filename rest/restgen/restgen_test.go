@@ -0,0 +1,218 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package restgen
+
+import (
+	"github.com/datacratic/gorest/rest"
+
+	"bytes"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type Item struct {
+	Key   string            `json:"key"`
+	Value int               `json:"value"`
+	Tags  []string          `json:"tags,omitempty"`
+	Attrs map[string]string `json:"attrs"`
+	Next  *Item             `json:"next"`
+}
+
+type Upload struct {
+	Item Item      `part:"item"`
+	File io.Reader `part:"file"`
+}
+
+type ItemService struct{}
+
+func (*ItemService) Get(key string) (*Item, error)   { return nil, nil }
+func (*ItemService) Put(key string, item Item) error { return nil }
+func (*ItemService) List() []Item                    { return nil }
+func (*ItemService) Count(prefix string, n int) int  { return 0 }
+
+func (*ItemService) Upload(key string, upload *Upload) error { return nil }
+
+func (service *ItemService) RESTRoutes() rest.Routes {
+	return rest.Routes{
+		rest.NewRoute("/items/:key", "GET", service.Get),
+		rest.NewRoute("/items/cached/:key", "GET", service.Get),
+		rest.NewRoute("/items/:key", "PUT", service.Put),
+		rest.NewRoute("/items", "GET", service.List),
+		rest.NewNamedRoute("count-items", "/count/:prefix/:type", "GET", service.Count),
+		rest.NewRoute("/ping", "POST", func() {}),
+		rest.NewRoute("/items/:key/upload", "POST", service.Upload),
+	}
+}
+
+func generate(t *testing.T, gen *Generator, lang func(*Generator, *bytes.Buffer) error) string {
+	var buffer bytes.Buffer
+	if err := lang(gen, &buffer); err != nil {
+		t.Fatalf("FAIL: unexpected error: %s", err)
+	}
+	return buffer.String()
+}
+
+// testImporter imports packages from source except for this package which
+// includes its test files such that the generated code can refer to the types
+// declared by the tests.
+type testImporter struct {
+	fset   *token.FileSet
+	source types.Importer
+}
+
+func (imp *testImporter) Import(path string) (*types.Package, error) {
+	if path != reflect.TypeOf(Item{}).PkgPath() {
+		return imp.source.Import(path)
+	}
+
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed []*ast.File
+	for _, name := range files {
+		file, err := parser.ParseFile(imp.fset, name, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, file)
+	}
+
+	config := &types.Config{Importer: imp.source}
+	return config.Check(path, imp.fset, parsed, nil)
+}
+
+// typeCheck parses and type-checks the given generated Go code.
+func typeCheck(src string) error {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "client.go", src, 0)
+	if err != nil {
+		return err
+	}
+
+	config := &types.Config{Importer: &testImporter{fset, importer.ForCompiler(fset, "source", nil)}}
+	_, err = config.Check(file.Name.Name, fset, []*ast.File{file}, nil)
+	return err
+}
+
+// checkTypeScript type-checks the given generated TypeScript code with tsc.
+// The test is skipped if tsc isn't installed.
+func checkTypeScript(t *testing.T, src string) {
+	tsc, err := exec.LookPath("tsc")
+	if err != nil {
+		t.Skip("tsc not found")
+	}
+
+	path := filepath.Join(t.TempDir(), "client.ts")
+	if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(tsc, "--noEmit", "--strict", "--target", "es2017", "--lib", "es2017,dom", path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("FAIL: invalid generated code: %s: %s\n%s", err, out, src)
+	}
+}
+
+func expectContains(t *testing.T, src string, exp ...string) {
+	for _, str := range exp {
+		if !strings.Contains(src, str) {
+			t.Errorf("FAIL: missing '%s' in:\n%s", str, src)
+		}
+	}
+}
+
+func TestGo(t *testing.T) {
+	mux := new(rest.Mux)
+	mux.AddService(new(ItemService))
+
+	gen := &Generator{
+		Name:    "ItemService",
+		Package: "items",
+		PkgPath: "example.com/items",
+		Routes:  mux.Routes(),
+	}
+
+	src := generate(t, gen, func(gen *Generator, buffer *bytes.Buffer) error { return gen.Go(buffer) })
+
+	if err := typeCheck(src); err != nil {
+		t.Fatalf("FAIL: invalid generated code: %s\n%s", err, src)
+	}
+
+	expectContains(t, src,
+		"type ItemServiceClient struct",
+		"func NewItemServiceClient(host string) *ItemServiceClient",
+		"func (client *ItemServiceClient) GetItemsKey(key string) (result *restgen.Item, err *rest.Error)",
+		"func (client *ItemServiceClient) GetItemsCachedKey(key string) (result *restgen.Item, err *rest.Error)",
+		"func (client *ItemServiceClient) Put(key string, body restgen.Item) (err *rest.Error)",
+		"func (client *ItemServiceClient) List() (result []restgen.Item, err *rest.Error)",
+		"func (client *ItemServiceClient) CountItems(prefix string, typeArg int) (result int, err *rest.Error)",
+		"func (client *ItemServiceClient) PostPing() (err *rest.Error)",
+		"func (client *ItemServiceClient) Upload(key string, body *rest.Multipart) (err *rest.Error)",
+		"SetMultipart(body)",
+		`"github.com/datacratic/gorest/rest/restgen"`,
+	)
+
+	gen.PkgPath = "github.com/datacratic/gorest/rest/restgen"
+	src = generate(t, gen, func(gen *Generator, buffer *bytes.Buffer) error { return gen.Go(buffer) })
+
+	expectContains(t, src, "func (client *ItemServiceClient) List() (result []Item, err *rest.Error)")
+}
+
+func TestTypeScript(t *testing.T) {
+	mux := new(rest.Mux)
+	mux.AddService(new(ItemService))
+
+	gen := &Generator{Name: "ItemService", Routes: mux.Routes()}
+	src := generate(t, gen, func(gen *Generator, buffer *bytes.Buffer) error { return gen.TypeScript(buffer) })
+
+	expectContains(t, src,
+		"export interface Item {",
+		`"key": string;`,
+		`"value": number;`,
+		`"tags"?: string[] | null;`,
+		`"attrs": { [key: string]: string } | null;`,
+		`"next": Item | null;`,
+		"export class ItemServiceClient {",
+		"getItemsKey(key: string): Promise<Item | null>",
+		"put(key: string, body: Item): Promise<void>",
+		"list(): Promise<Item[] | null>",
+		"countItems(prefix: string, typeArg: number): Promise<number>",
+		"upload(key: string, body: FormData): Promise<void>",
+		"`/count/${encodeURIComponent(String(prefix))}/${encodeURIComponent(String(typeArg))}`",
+	)
+
+	if n := strings.Count(src, "export interface Item "); n != 1 {
+		t.Errorf("FAIL: unexpected number of Item interfaces: %d", n)
+	}
+
+	checkTypeScript(t, src)
+}
+
+func TestNames(t *testing.T) {
+	for _, test := range []struct{ str, exported, arg string }{
+		{"item-key", "ItemKey", "itemKey"},
+		{"éclair", "Éclair", "éclair"},
+		{"ßig", "Xßig", "xßig"},
+		{"2nd", "X2nd", "x2nd"},
+		{"type", "Type", "typeArg"},
+	} {
+		if name := exported(test.str); name != test.exported {
+			t.Errorf("FAIL(%s): unexpected exported name: %s != %s", test.str, name, test.exported)
+		}
+		if name := argName(test.str); name != test.arg {
+			t.Errorf("FAIL(%s): unexpected argument name: %s != %s", test.str, name, test.arg)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package restgen
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	rawMessageType    = reflect.TypeOf(json.RawMessage{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// tsTypes tracks the TypeScript interfaces that need to be emitted for the
+// named Go struct types referenced by the routes.
+type tsTypes struct {
+	names map[reflect.Type]string
+	taken map[string]bool
+	order []reflect.Type
+	decls map[reflect.Type]string
+}
+
+func newTSTypes() *tsTypes {
+	return &tsTypes{
+		names: make(map[reflect.Type]string),
+		taken: make(map[string]bool),
+		decls: make(map[reflect.Type]string),
+	}
+}
+
+// typeName returns the TypeScript type that matches the JSON encoding of the
+// given Go type as performed by the encoding/json package.
+func (types *tsTypes) typeName(t reflect.Type) (string, error) {
+	switch {
+	case t == timeType:
+		return "string", nil
+
+	case t == rawMessageType:
+		return "any", nil
+
+	case t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType):
+		return "any", nil
+
+	case t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType):
+		return "string", nil
+	}
+
+	switch t.Kind() {
+
+	case reflect.Bool:
+		return "boolean", nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number", nil
+
+	case reflect.String:
+		return "string", nil
+
+	case reflect.Interface:
+		return "any", nil
+
+	case reflect.Ptr:
+		elem, err := types.typeName(t.Elem())
+		return elem + " | null", err
+
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "string", nil
+		}
+
+		elem, err := types.typeName(t.Elem())
+		if strings.ContainsAny(elem, " |") {
+			elem = "(" + elem + ")"
+		}
+		if t.Kind() == reflect.Slice {
+			return elem + "[] | null", err
+		}
+		return elem + "[]", err
+
+	case reflect.Map:
+		elem, err := types.typeName(t.Elem())
+		return "{ [key: string]: " + elem + " } | null", err
+
+	case reflect.Struct:
+		if len(t.Name()) == 0 {
+			return types.object(t)
+		}
+		return types.named(t)
+	}
+
+	return "", fmt.Errorf("unsupported type '%s'", t)
+}
+
+func (types *tsTypes) named(t reflect.Type) (string, error) {
+	if name, ok := types.names[t]; ok {
+		return name, nil
+	}
+
+	base := exported(t.Name())
+	name := base
+	for i := 2; types.taken[name]; i++ {
+		name = fmt.Sprintf("%s%d", base, i)
+	}
+
+	// Registered before generating the fields to handle recursive types.
+	types.names[t] = name
+	types.taken[name] = true
+	types.order = append(types.order, t)
+
+	decl, err := types.object(t)
+	if err != nil {
+		return "", err
+	}
+
+	types.decls[t] = decl
+	return name, nil
+}
+
+func (types *tsTypes) object(t reflect.Type) (string, error) {
+	var fields []string
+	if err := types.fields(t, &fields); err != nil {
+		return "", err
+	}
+
+	if len(fields) == 0 {
+		return "{}", nil
+	}
+	return "{\n" + strings.Join(fields, "") + "}", nil
+}
+
+func (types *tsTypes) fields(t reflect.Type, fields *[]string) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		opts := strings.Split(tag, ",")
+		name := opts[0]
+
+		// Untagged embedded structs have their fields promoted by
+		// encoding/json.
+		if field.Anonymous && len(name) == 0 {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+
+			if embedded.Kind() == reflect.Struct {
+				if err := types.fields(embedded, fields); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+
+		if len(name) == 0 {
+			name = field.Name
+		}
+
+		optional := ""
+		typ := ""
+
+		for _, opt := range opts[1:] {
+			switch opt {
+			case "omitempty":
+				optional = "?"
+			case "string":
+				typ = "string"
+			}
+		}
+
+		if len(typ) == 0 {
+			var err error
+			if typ, err = types.typeName(field.Type); err != nil {
+				return fmt.Errorf("invalid field '%s' of '%s': %s", field.Name, t, err)
+			}
+		}
+
+		*fields = append(*fields, fmt.Sprintf("  %q%s: %s;\n", name, optional, typ))
+	}
+
+	return nil
+}
+
+// nullable indicates whether the handler of a route may return a nil value
+// for the given type in which case the response will have no content.
+func nullable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Interface, reflect.Map, reflect.Slice:
+		return true
+	}
+	return false
+}
+
+func lowerCamel(name string) string {
+	return lowerFirst(name)
+}
+
+// TypeScript writes the source of a typed TypeScript client for the routes to
+// the given writer. The generated module exports an interface for each named
+// struct type used in the body or the return value of a handler along with a
+// client class based on fetch which provides one method per route.
+func (gen *Generator) TypeScript(writer io.Writer) error {
+	types := newTSTypes()
+	client := exported(gen.Name) + "Client"
+
+	var body bytes.Buffer
+
+	for _, m := range gen.methods() {
+		var params []string
+		path := ""
+
+		i := 0
+		for _, item := range m.Route.Path {
+			if !item.IsArg {
+				path += "/" + item.Name
+				continue
+			}
+
+			arg := m.Args[i]
+			i++
+
+			typ, err := types.typeName(arg.Type)
+			if err != nil {
+				return fmt.Errorf("invalid argument '%s' for route %s: %s", arg.Name, m.Route, err)
+			}
+
+			params = append(params, arg.Name+": "+typ)
+			path += "/${encodeURIComponent(String(" + arg.Name + "))}"
+		}
+
+		if len(path) == 0 {
+			path = "/"
+		}
+
+		send := fmt.Sprintf("%q, `%s`", m.Route.Method, path)
+
+		if m.Route.IsMultipart() {
+			params = append(params, "body: FormData")
+			send += ", body"
+
+		} else if m.Body != nil {
+			typ, err := types.typeName(m.Body)
+			if err != nil {
+				return fmt.Errorf("invalid body for route %s: %s", m.Route, err)
+			}
+			params = append(params, "body: "+typ)
+			send += ", body"
+		}
+
+		result := "void"
+		if m.Return != nil {
+			var err error
+			if result, err = types.typeName(m.Return); err != nil {
+				return fmt.Errorf("invalid return for route %s: %s", m.Route, err)
+			}
+
+			if nullable(m.Return) && !strings.HasSuffix(result, " | null") {
+				result += " | null"
+			}
+		}
+
+		fmt.Fprintf(&body, "\n  /** %s sends a %s request to %s. */\n", lowerCamel(m.Name), m.Route.Method, m.Route.Path)
+		fmt.Fprintf(&body, "  %s(%s): Promise<%s> {\n", lowerCamel(m.Name), strings.Join(params, ", "), result)
+		fmt.Fprintf(&body, "    return this._send<%s>(%s);\n", result, send)
+		fmt.Fprintf(&body, "  }\n")
+	}
+
+	var src bytes.Buffer
+	fmt.Fprintf(&src, "// Code generated by restgen. DO NOT EDIT.\n")
+
+	for _, t := range types.order {
+		fmt.Fprintf(&src, "\n/** %s is the JSON representation of %s. */\n", types.names[t], t)
+		fmt.Fprintf(&src, "export interface %s %s\n", types.names[t], types.decls[t])
+	}
+
+	fmt.Fprintf(&src, "%s", `
+/** RESTError is thrown when the endpoint responds with an error status. */
+export class RESTError extends Error {
+  constructor(public status: number, public body: string) {
+    super(body);
+  }
+}
+`)
+
+	fmt.Fprintf(&src, "\n/** %s is a typed REST client for the routes of %s. */\n", client, gen.Name)
+	fmt.Fprintf(&src, "export class %s {\n", client)
+	fmt.Fprintf(&src, "%s", `  constructor(
+    public host: string,
+    public root: string = "",
+    public init: RequestInit = {},
+  ) {}
+
+  private async _send<T>(method: string, path: string, body?: unknown): Promise<T> {
+    const url = this.host.replace(/\/+$/, "") + this.root.replace(/\/+$/, "") + path;
+    const headers = new Headers(this.init.headers);
+    const form = body instanceof FormData;
+    if (!form) {
+      headers.set("Content-Type", "application/json");
+    }
+
+    const resp = await fetch(url, {
+      ...this.init,
+      method,
+      headers,
+      body: body === undefined ? undefined : form ? (body as FormData) : JSON.stringify(body),
+    });
+
+    if (!resp.ok) {
+      throw new RESTError(resp.status, await resp.text());
+    }
+
+    if (resp.status === 204) {
+      return null as T;
+    }
+
+    return (await resp.json()) as T;
+  }
+`)
+	src.Write(body.Bytes())
+	fmt.Fprintf(&src, "}\n")
+
+	_, err := writer.Write(src.Bytes())
+	return err
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package resttest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// TokenServer is a stand-in OAuth2 token endpoint which issues bearer tokens
+// via the client credentials grant. It's meant to test clients using
+// rest.ClientCredentials.
+type TokenServer struct {
+	*httptest.Server
+
+	// ClientID and ClientSecret are the credentials accepted by the server.
+	ClientID     string
+	ClientSecret string
+
+	// TTL is the lifetime of the issued tokens. If not set then the tokens
+	// don't expire.
+	TTL time.Duration
+
+	mutex  sync.Mutex
+	tokens map[string]time.Time
+	issued int
+}
+
+// NewTokenServer creates a new token server which accepts the given client
+// credentials.
+func NewTokenServer(clientID, clientSecret string) *TokenServer {
+	server := &TokenServer{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		tokens:       make(map[string]time.Time),
+	}
+
+	server.Server = httptest.NewServer(http.HandlerFunc(server.serveToken))
+	return server
+}
+
+// TokenURL returns the URL of the token endpoint.
+func (server *TokenServer) TokenURL() string {
+	return server.URL + "/token"
+}
+
+// Issued returns the number of tokens issued so far.
+func (server *TokenServer) Issued() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.issued
+}
+
+// Valid indicates whether the given token was issued by the server and is
+// neither expired nor revoked.
+func (server *TokenServer) Valid(token string) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	expires, ok := server.tokens[token]
+	return ok && (expires.IsZero() || time.Now().Before(expires))
+}
+
+// Revoke invalidates all the tokens issued so far.
+func (server *TokenServer) Revoke() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.tokens = make(map[string]time.Time)
+}
+
+func (server *TokenServer) serveToken(writer http.ResponseWriter, httpReq *http.Request) {
+	if httpReq.Method != "POST" || httpReq.URL.Path != "/token" {
+		http.NotFound(writer, httpReq)
+		return
+	}
+
+	id, secret, _ := httpReq.BasicAuth()
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+
+	if id != server.ClientID || secret != server.ClientSecret {
+		writeJSON(writer, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	if httpReq.PostFormValue("grant_type") != "client_credentials" {
+		writeJSON(writer, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	buffer := make([]byte, 16)
+	rand.Read(buffer)
+	token := hex.EncodeToString(buffer)
+
+	server.mutex.Lock()
+
+	var expires time.Time
+	if server.TTL > 0 {
+		expires = time.Now().Add(server.TTL)
+	}
+
+	server.tokens[token] = expires
+	server.issued++
+
+	server.mutex.Unlock()
+
+	result := map[string]interface{}{"access_token": token, "token_type": "bearer"}
+	if server.TTL > 0 {
+		result["expires_in"] = int64(server.TTL / time.Second)
+	}
+
+	writeJSON(writer, http.StatusOK, result)
+}
+
+func writeJSON(writer http.ResponseWriter, code int, obj interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(code)
+	json.NewEncoder(writer).Encode(obj)
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultMinBackoff is the default delay before the first retry of a
+	// request.
+	DefaultMinBackoff = 10 * time.Millisecond
+
+	// DefaultMaxBackoff is the default maximum delay between two attempts of
+	// a request.
+	DefaultMaxBackoff = 1 * time.Second
+)
+
+// DefaultRetryErrorTypes is the list of error types that are retried if
+// RetryPolicy.ErrorTypes is not set.
+var DefaultRetryErrorTypes = []ErrorType{TimeoutError, SendRequestError}
+
+// DefaultRetryStatusCodes is the list of HTTP status codes that are retried if
+// RetryPolicy.StatusCodes is not set.
+var DefaultRetryStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// RetryPolicy controls how a request is retried when an attempt fails. Delays
+// between attempts grow exponentially from MinBackoff up to MaxBackoff and are
+// randomized according to Jitter. Slots reserved via Client.Limit are released
+// while waiting between attempts.
+type RetryPolicy struct {
+
+	// MaxAttempts is the maximum number of attempts made for a request,
+	// including the first one. Values lower than 2 disable retries.
+	MaxAttempts int
+
+	// MinBackoff is the delay before the first retry. Defaults to
+	// DefaultMinBackoff.
+	MinBackoff time.Duration
+
+	// MaxBackoff is the maximum delay between two attempts. Defaults to
+	// DefaultMaxBackoff. A Retry-After header requesting a longer delay stops
+	// the retries.
+	MaxBackoff time.Duration
+
+	// Multiplier is the factor applied to the delay after each attempt.
+	// Defaults to 2.
+	Multiplier float64
+
+	// Jitter is the fraction, between 0 and 1, of each delay that is
+	// randomized. A jitter of 0.5 yields delays between 50% and 100% of the
+	// computed delay. Values outside of [0, 1] are clamped.
+	Jitter float64
+
+	// ErrorTypes is the list of error types which are retried. Defaults to
+	// DefaultRetryErrorTypes.
+	ErrorTypes []ErrorType
+
+	// StatusCodes is the list of HTTP status codes which are retried.
+	// Defaults to DefaultRetryStatusCodes.
+	StatusCodes []int
+
+	// RetryNonIdempotent allows retries of requests whose HTTP method is not
+	// idempotent (e.g. POST and PATCH). Disabled by default since retrying
+	// these requests could apply their side effects multiple times unless the
+	// route is Idempotent. Such requests are sent with a random
+	// Idempotency-Key header if they don't already have one and are retried
+	// when rejected with a 409 status code because a previous attempt is still
+	// in progress.
+	RetryNonIdempotent bool
+}
+
+// IsIdempotent returns true if the given HTTP method is idempotent as defined
+// in RFC 7231.
+func IsIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+func (policy *RetryPolicy) retryable(req *Request, resp *Response, attempt int) bool {
+	if policy == nil || attempt >= policy.MaxAttempts {
+		return false
+	}
+
+	if !policy.RetryNonIdempotent && !IsIdempotent(req.Method) {
+		return false
+	}
+
+	if resp.Error != nil {
+		errorTypes := policy.ErrorTypes
+		if errorTypes == nil {
+			errorTypes = DefaultRetryErrorTypes
+		}
+
+		for _, errType := range errorTypes {
+			if resp.Error.Type == errType {
+				return true
+			}
+		}
+		return false
+	}
+
+	// A conflict with a Retry-After header on a request carrying an
+	// idempotency key means that a previous attempt is still in progress on
+	// the server whose response can be replayed once it completes. Conflicts
+	// returned by the handler itself are final.
+	if resp.Code == http.StatusConflict && len(req.Header.Get(IdempotencyKeyHeader)) > 0 {
+		return len(resp.Header.Get("Retry-After")) > 0
+	}
+
+	statusCodes := policy.StatusCodes
+	if statusCodes == nil {
+		statusCodes = DefaultRetryStatusCodes
+	}
+
+	for _, code := range statusCodes {
+		if resp.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay to wait before the next attempt or false if the
+// retries should be aborted.
+func (policy *RetryPolicy) backoff(resp *Response, attempt int) (time.Duration, bool) {
+	minBackoff := policy.MinBackoff
+	if minBackoff == 0 {
+		minBackoff = DefaultMinBackoff
+	}
+
+	maxBackoff := policy.MaxBackoff
+	if maxBackoff == 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+
+	multiplier := policy.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+
+	delay := float64(minBackoff)
+	for i := 1; i < attempt && delay < float64(maxBackoff); i++ {
+		delay *= multiplier
+	}
+
+	if delay > float64(maxBackoff) {
+		delay = float64(maxBackoff)
+	}
+
+	if jitter := math.Min(policy.Jitter, 1); jitter > 0 {
+		delay -= delay * jitter * rand.Float64()
+	}
+
+	if retryAfter, ok := resp.RetryAfter(); ok {
+		if retryAfter > maxBackoff {
+			return 0, false
+		}
+
+		if retryAfter > time.Duration(delay) {
+			return retryAfter, true
+		}
+	}
+
+	return time.Duration(delay), true
+}
+
+// RetryAfter returns the delay requested by the Retry-After header of the
+// response which can either be expressed in seconds or as an HTTP date.
+func (resp *Response) RetryAfter() (time.Duration, bool) {
+	if resp.Header == nil {
+		return 0, false
+	}
+
+	value := resp.Header.Get("Retry-After")
+	if len(value) == 0 {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := date.Sub(time.Now()); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
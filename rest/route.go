@@ -7,10 +7,14 @@ import (
 
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"mime/multipart"
 	"reflect"
+	"runtime"
 	"strconv"
 	"sync"
+	"time"
 )
 
 // Routable is used to detect objects that are routable by an Endpoint.
@@ -36,10 +40,34 @@ func (routes Routes) Swap(i, j int) {
 	routes[i], routes[j] = routes[j], routes[i]
 }
 
+// Find returns the route with the given name or nil if no such route exists.
+func (routes Routes) Find(name string) *Route {
+	for _, route := range routes {
+		if route.Name == name {
+			return route
+		}
+	}
+	return nil
+}
+
+// URL builds the path of the route with the given name using the given path
+// arguments. See Path.Format for further details.
+func (routes Routes) URL(name string, args ...interface{}) (string, error) {
+	route := routes.Find(name)
+	if route == nil {
+		return "", fmt.Errorf("unknown route name: '%s'", name)
+	}
+	return route.Path.Format(args...)
+}
+
 // Route associates a handler which should be invoked for a given HTTP method
 // and templated path.
 type Route struct {
 
+	// Name is an optional identifier for the route which can be used to build
+	// URLs via Routes.URL or Mux.URL. Names must be unique within a Mux.
+	Name string
+
 	// Path is the templated path required by this route. See Handler for the
 	// rules related to path.
 	Path Path
@@ -58,18 +86,105 @@ type Route struct {
 	// in the same order as the function arguments with the last function
 	// argument being the body.
 	//
+	// The function can also declare a *Principal as its first argument in
+	// which case it receives the caller as authenticated by the Authenticator
+	// of the Mux. It can then declare a *Precondition argument in which case
+	// it receives the If-Match header of the request.
+	//
+	// If the body argument is a struct, or a pointer to a struct, with fields
+	// tagged with `part:"name"` then the request must be a
+	// multipart/form-data request whose parts are bound to the tagged fields.
+	// File parts can be bound to *multipart.FileHeader or io.Reader fields
+	// while other fields are unmarshalled from the JSON content of the parts.
+	//
 	// If any of the previous rules are broken, Route will panic when Init is
 	// called.
 	Handler interface{}
 
+	// Public allows unauthenticated requests when the Mux has an
+	// Authenticator. The principal is still passed to the handler if the
+	// request carries valid credentials.
+	Public bool
+
+	// Scopes is the list of scopes that the caller must all have been
+	// granted to invoke the route.
+	Scopes []string
+
+	// Roles is the list of roles of which the caller must have at least one
+	// to invoke the route.
+	Roles []string
+
+	// Version is an optional function which returns the entity tag of the
+	// current version of the resource targeted by the route. It accepts the
+	// path arguments like the handler and returns a string and optionally an
+	// error. An empty string indicates that the resource doesn't exist. If
+	// set then requests whose If-Match header doesn't match the current
+	// version are rejected with a 412 status code before the handler is
+	// invoked. Since the resource can change between the check and the
+	// invocation of the handler, the check only rejects stale requests early:
+	// handlers which must not lose updates should receive the Precondition
+	// and match it again while holding the lock which guards their resource.
+	Version interface{}
+
+	// RequireIfMatch rejects requests without an If-Match header with a 428
+	// status code.
+	RequireIfMatch bool
+
+	// Throttle limits the load accepted by the route in addition to the
+	// Throttle of the Mux.
+	Throttle *Throttle
+
+	// Idempotent enables the Idempotency-Key header for the route. The
+	// response of a request carrying a key is stored in the IdempotencyStore
+	// of the Mux and replayed for the subsequent requests with the same key,
+	// path and principal. Requests whose key is still in progress are
+	// rejected with a 409 status code.
+	Idempotent bool
+
+	// IdempotencyTTL is the duration for which the responses of an
+	// Idempotent route are stored. Defaults to DefaultIdempotencyTTL.
+	IdempotencyTTL time.Duration
+
+	// IdempotencyLease is the duration for which the key of a request to an
+	// Idempotent route is held while the request is in flight. A request
+	// repeated after the lease expired is served again. Defaults to
+	// DefaultIdempotencyLease.
+	IdempotencyLease time.Duration
+
+	// MaxBodySize is the maximum size in bytes of the body of a request.
+	// Larger requests are rejected with a 413 status code. If not set then
+	// the size of the body is unbounded.
+	MaxBodySize int64
+
+	// MaxMemory is the number of bytes of a multipart request body kept in
+	// memory before the remaining parts are stored in temporary files.
+	// Defaults to DefaultMaxMemory.
+	MaxMemory int64
+
 	// GzipLevel is used to set the response gzip compression level.
 	GzipLevel int
 
+	// CacheTTL enables the caching of the responses of a GET route for the
+	// given duration. Responses are cached separately for each set of path
+	// arguments and, if the handler accepts a *Principal, for each caller.
+	// Only successful responses are cached. Handlers with a body or a
+	// *Precondition argument can't be cached.
+	CacheTTL time.Duration
+
+	// CacheSize is the maximum number of responses cached by the route.
+	// Defaults to DefaultCacheSize.
+	CacheSize int
+
 	initialize sync.Once
 
-	handler     reflect.Value
-	handlerType reflect.Type
-	bodyType    reflect.Type
+	handler      reflect.Value
+	handlerType  reflect.Type
+	bodyType     reflect.Type
+	form         bool
+	principal    bool
+	precondition bool
+	versionFunc  reflect.Value
+	cache        responseCache
 
 	inBody   int
 	outBody  int
@@ -88,6 +203,19 @@ func NewRoute(path, method string, handler interface{}) *Route {
 	return route
 }
 
+// NewNamedRoute creates and initializes a new named Route from the method,
+// path and handler.
+func NewNamedRoute(name, path, method string, handler interface{}) *Route {
+	route := &Route{
+		Name:    name,
+		Path:    NewPath(path),
+		Method:  method,
+		Handler: handler,
+	}
+	route.Init()
+	return route
+}
+
 // NewRouteGzip creates and initializea a new Route from the method, path and
 // handler. And will gzip compress the returned value.
 func NewRouteGzip(path, method string, handler interface{}, level int) *Route {
@@ -118,6 +246,16 @@ func (route *Route) init() {
 	pathArgs := route.Path.NumArgs()
 	handlerArgs := route.handlerType.NumIn()
 
+	if handlerArgs > 0 && route.handlerType.In(0) == principalType {
+		route.principal = true
+		handlerArgs--
+	}
+
+	if handlerArgs > 0 && route.handlerType.In(route.extraArgs()) == preconditionType {
+		route.precondition = true
+		handlerArgs--
+	}
+
 	if pathArgs < handlerArgs-1 {
 		log.Panicf("not enough path arguments for route { %s %s }: %d < %d",
 			route.Method, route.Path, pathArgs, handlerArgs-1)
@@ -128,7 +266,22 @@ func (route *Route) init() {
 
 	} else if pathArgs < handlerArgs {
 		route.inBody = handlerArgs
-		route.bodyType = route.handlerType.In(route.inBody - 1)
+		route.bodyType = route.handlerType.In(route.handlerType.NumIn() - 1)
+		route.form = isForm(route.bodyType)
+	}
+
+	route.initVersion()
+
+	if route.CacheTTL > 0 && route.Method != "GET" {
+		log.Panicf("response caching requires a GET route for route %s", route)
+	}
+
+	if route.CacheTTL > 0 && route.HasBodyParam() {
+		log.Panicf("response caching requires a handler without a body argument for route %s", route)
+	}
+
+	if route.CacheTTL > 0 && route.precondition {
+		log.Panicf("response caching requires a handler without a *Precondition argument for route %s", route)
 	}
 
 	if route.handlerType.NumOut() > 2 {
@@ -210,16 +363,58 @@ func (route *Route) isNil(obj reflect.Value) bool {
 }
 
 func (route *Route) invoke(args []string, body []byte) ([]byte, *Error) {
+	out, err := route.invokeAs(nil, nil, args, body)
+	if err != nil {
+		return nil, err
+	}
+	return out.body, nil
+}
+
+// invokeAs invokes the handler on behalf of the given principal and with the
+// given precondition.
+func (route *Route) invokeAs(principal *Principal, precondition *Precondition, args []string, body []byte) (*output, *Error) {
+	return route.call(principal, precondition, args, func(arg reflect.Value) error {
+		return json.Unmarshal(body, arg.Interface())
+	})
+}
+
+// invokeForm invokes the handler with the body argument bound to the parts of
+// the given multipart form.
+func (route *Route) invokeForm(principal *Principal, precondition *Precondition, args []string, form *multipart.Form) (*output, *Error) {
+	var closers []io.Closer
+
+	defer func() {
+		for _, closer := range closers {
+			closer.Close()
+		}
+	}()
+
+	return route.call(principal, precondition, args, func(arg reflect.Value) error {
+		return bindForm(form, arg.Elem(), &closers)
+	})
+}
+
+// call invokes the handler with the given principal, precondition and path
+// arguments and with the body argument filled in by bind.
+func (route *Route) call(principal *Principal, precondition *Precondition, args []string, bind func(reflect.Value) error) (*output, *Error) {
 	var err error
 	var in []reflect.Value
 
-	for i := 0; i < route.handlerType.NumIn(); i++ {
-		arg := reflect.New(route.handlerType.In(i))
+	if route.principal {
+		in = append(in, reflect.ValueOf(principal))
+	}
+
+	if route.precondition {
+		in = append(in, reflect.ValueOf(precondition))
+	}
+
+	for i := 0; len(in) < route.handlerType.NumIn(); i++ {
+		arg := reflect.New(route.handlerType.In(len(in)))
 
 		if i < len(args) {
 			err = route.parseArg(args[i], arg.Elem())
 		} else {
-			err = json.Unmarshal(body, arg.Interface())
+			err = bind(arg)
 		}
 
 		if err != nil {
@@ -236,12 +431,18 @@ func (route *Route) invoke(args []string, body []byte) ([]byte, *Error) {
 		return nil, &Error{HandlerError, err}
 	}
 
-	var ret []byte
+	ret := new(output)
 
 	if route.outBody >= 0 && !route.isNil(out[route.outBody]) {
-		if ret, err = json.Marshal(out[route.outBody].Interface()); err != nil {
+		value := out[route.outBody].Interface()
+		if ret.body, err = json.Marshal(value); err != nil {
 			return nil, &Error{MarshalError, err}
 		}
+		ret.describe(value)
+
+		if route.Method == "GET" && len(ret.etag) == 0 {
+			ret.etag = hashETag(ret.body)
+		}
 	}
 
 	return ret, nil
@@ -251,6 +452,74 @@ func (route *Route) HasBodyParam() bool {
 	return route.bodyType != nil && route.bodyType.Kind() != reflect.Invalid
 }
 
+// IsMultipart indicates whether the body of the requests is bound from the
+// parts of a multipart/form-data request.
+func (route *Route) IsMultipart() bool {
+	route.Init()
+	return route.form
+}
+
+func (route *Route) maxMemory() int64 {
+	if route.MaxMemory > 0 {
+		return route.MaxMemory
+	}
+	return DefaultMaxMemory
+}
+
+// ArgTypes returns the types of the handler arguments that are fed from the
+// path arguments, in the order in which they appear in the path.
+func (route *Route) ArgTypes() []reflect.Type {
+	route.Init()
+
+	types := make([]reflect.Type, route.Path.NumArgs())
+	for i := range types {
+		types[i] = route.handlerType.In(route.extraArgs() + i)
+	}
+	return types
+}
+
+// extraArgs returns the number of handler arguments which precede the path
+// arguments.
+func (route *Route) extraArgs() int {
+	n := 0
+	if route.principal {
+		n++
+	}
+	if route.precondition {
+		n++
+	}
+	return n
+}
+
+// BodyType returns the type of the handler argument that is fed from the body
+// of the request or nil if the handler doesn't accept a body.
+func (route *Route) BodyType() reflect.Type {
+	route.Init()
+	return route.bodyType
+}
+
+// ReturnType returns the type of the value returned by the handler which is
+// used as the body of the response or nil if the handler doesn't return one.
+func (route *Route) ReturnType() reflect.Type {
+	route.Init()
+
+	if route.outBody < 0 {
+		return nil
+	}
+	return route.handlerType.Out(route.outBody)
+}
+
+// HandlerName returns the fully qualified name of the handler function as
+// reported by the runtime.
+func (route *Route) HandlerName() string {
+	route.Init()
+
+	if fn := runtime.FuncForPC(route.handler.Pointer()); fn != nil {
+		return fn.Name()
+	}
+	return ""
+}
+
 // JsonSchema returns a json schema for the body if there is a body.
 func (route *Route) JsonSchema() string {
 	if route.bodyType != nil && route.bodyType.Kind() != reflect.Invalid {
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func printPath(path ...PathItem) string {
@@ -366,3 +367,20 @@ func BenchmarkRouteInvokeAll(b *testing.B) {
 
 	BenchRouteInvoke(b, route, args, body)
 }
+
+func TestRouteCacheInit(t *testing.T) {
+	initRoute := func(title, method string, handler interface{}) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("FAIL(%s): expected panic", title)
+			}
+		}()
+
+		route := &Route{Path: NewPath("/a"), Method: method, Handler: handler, CacheTTL: time.Minute}
+		route.Init()
+	}
+
+	initRoute("method", "POST", func() int { return 1 })
+	initRoute("body", "GET", func(obj T) int { return obj.Value })
+	initRoute("precondition", "GET", func(precondition *Precondition) int { return 1 })
+}
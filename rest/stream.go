@@ -0,0 +1,296 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is a server-sent event as defined by the EventSource specification.
+type Event struct {
+
+	// ID is the id of the event.
+	ID string
+
+	// Type is the type of the event. Empty for the default message type.
+	Type string
+
+	// Data is the payload of the event where multiple data lines are joined
+	// with a newline.
+	Data string
+
+	// Retry is the reconnection delay requested by the server. Zero if not
+	// specified.
+	Retry time.Duration
+}
+
+// sink delivers the values decoded from a streamed response either to a
+// callback or to a channel.
+type sink struct {
+	ctx  context.Context
+	fn   reflect.Value
+	ch   reflect.Value
+	elem reflect.Type
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// newSink validates the target of a streamed response which must either be a
+// function of the form func(T) or func(T) error or a channel of T. Invalid
+// targets cause a panic.
+func newSink(ctx context.Context, target interface{}) *sink {
+	value := reflect.ValueOf(target)
+	typ := value.Type()
+
+	switch typ.Kind() {
+
+	case reflect.Func:
+		if typ.NumIn() != 1 || typ.NumOut() > 1 || typ.NumOut() == 1 && typ.Out(0) != errorType {
+			log.Panicf("invalid stream callback: got '%s' expected 'func(T) error'", typ)
+		}
+		return &sink{ctx: ctx, fn: value, elem: typ.In(0)}
+
+	case reflect.Chan:
+		if typ.ChanDir()&reflect.SendDir == 0 {
+			log.Panicf("invalid stream channel: got '%s' expected 'chan<- T'", typ)
+		}
+		return &sink{ctx: ctx, ch: value, elem: typ.Elem()}
+	}
+
+	log.Panicf("invalid stream target: got '%s' expected 'func' or 'chan'", typ)
+	return nil
+}
+
+// put delivers the value to the target and returns an error if the callback
+// failed or if the context is done while waiting on the channel.
+func (sink *sink) put(value reflect.Value) *Error {
+	if sink.fn.IsValid() {
+		out := sink.fn.Call([]reflect.Value{value})
+		if len(out) == 1 && !out[0].IsNil() {
+			return &Error{StreamError, out[0].Interface().(error)}
+		}
+		return nil
+	}
+
+	chosen, _, _ := reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectSend, Chan: sink.ch, Send: value},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(sink.ctx.Done())},
+	})
+
+	if chosen == 1 {
+		return contextError(sink.ctx)
+	}
+	return nil
+}
+
+var eventType = reflect.TypeOf(Event{})
+
+// putEvent delivers the event to the target, unmarshalling its data unless the
+// target expects Event values.
+func (sink *sink) putEvent(event Event) *Error {
+	if sink.elem == eventType {
+		return sink.put(reflect.ValueOf(event))
+	}
+
+	value := reflect.New(sink.elem)
+	if err := json.Unmarshal([]byte(event.Data), value.Interface()); err != nil {
+		return &Error{UnmarshalError, err}
+	}
+	return sink.put(value.Elem())
+}
+
+func (sink *sink) close() {
+	if sink.ch.IsValid() {
+		sink.ch.Close()
+	}
+}
+
+// open checks the response for errors before reading its stream and returns a
+// sink for the given target.
+func (resp *Response) open(target interface{}) (*sink, *Error) {
+	ctx := context.Background()
+	if resp.Request != nil {
+		ctx = resp.Request.Context()
+	}
+
+	sink := newSink(ctx, target)
+
+	if resp.Stream == nil {
+		sink.close()
+
+		if err := resp.GetBody(nil); err != nil {
+			return nil, err
+		}
+		return nil, ErrorFmt(StreamError, "response is not streamed")
+	}
+
+	return sink, nil
+}
+
+// Close closes the stream of the response, if any.
+func (resp *Response) Close() error {
+	if resp.Stream == nil {
+		return nil
+	}
+	return resp.Stream.Close()
+}
+
+// streamError converts an error which occured while reading a stream into an
+// Error object.
+func streamError(ctx context.Context, err error) *Error {
+	if ctxErr := contextError(ctx); ctxErr != nil {
+		return ctxErr
+	}
+
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return &Error{UnmarshalError, err}
+	}
+	return &Error{ReadBodyError, err}
+}
+
+// ReadNDJSON decodes the newline delimited JSON values of a streamed response
+// one at a time and delivers them to the given target which must either be a
+// callback of the form func(T) or func(T) error or a channel of T. Decoding
+// stops if the callback returns an error or if the context of the request is
+// done. The stream and the channel are closed once decoding stops.
+func (resp *Response) ReadNDJSON(target interface{}) *Error {
+	sink, err := resp.open(target)
+	if err != nil {
+		return err
+	}
+
+	defer sink.close()
+	defer resp.Close()
+
+	decoder := json.NewDecoder(resp.Stream)
+
+	for {
+		value := reflect.New(sink.elem)
+
+		if err := decoder.Decode(value.Interface()); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return streamError(sink.ctx, err)
+		}
+
+		if err := sink.put(value.Elem()); err != nil {
+			return err
+		}
+	}
+}
+
+// ReadJSONArray decodes the elements of the JSON array of a streamed response
+// one at a time and delivers them to the given target. See ReadNDJSON for
+// further details.
+func (resp *Response) ReadJSONArray(target interface{}) *Error {
+	sink, err := resp.open(target)
+	if err != nil {
+		return err
+	}
+
+	defer sink.close()
+	defer resp.Close()
+
+	decoder := json.NewDecoder(resp.Stream)
+
+	if token, err := decoder.Token(); err != nil {
+		return streamError(sink.ctx, err)
+	} else if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return ErrorFmt(UnmarshalError, "expected JSON array: got '%v'", token)
+	}
+
+	for decoder.More() {
+		value := reflect.New(sink.elem)
+
+		if err := decoder.Decode(value.Interface()); err != nil {
+			return streamError(sink.ctx, err)
+		}
+
+		if err := sink.put(value.Elem()); err != nil {
+			return err
+		}
+	}
+
+	if _, err := decoder.Token(); err != nil {
+		return streamError(sink.ctx, err)
+	}
+
+	return nil
+}
+
+// ReadEvents decodes the server-sent events of a streamed response one at a
+// time and delivers them to the given target. If the target is of type Event
+// then the events are delivered as is, otherwise the data of each event is
+// unmarshalled as JSON. See ReadNDJSON for further details.
+func (resp *Response) ReadEvents(target interface{}) *Error {
+	sink, err := resp.open(target)
+	if err != nil {
+		return err
+	}
+
+	defer sink.close()
+	defer resp.Close()
+
+	reader := bufio.NewReader(resp.Stream)
+
+	var event Event
+	var data []string
+
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return streamError(sink.ctx, readErr)
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		// Blank lines dispatch the pending event, if any, and reset its
+		// fields except for the last event ID.
+		if len(line) == 0 {
+			if len(data) > 0 {
+				event.Data = strings.Join(data, "\n")
+
+				if err := sink.putEvent(event); err != nil {
+					return err
+				}
+			}
+
+			event, data = Event{ID: event.ID}, nil
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+
+		if len(line) == 0 || line[0] == ':' {
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+
+		switch field {
+		case "id":
+			event.ID = value
+		case "event":
+			event.Type = value
+		case "data":
+			data = append(data, value)
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil {
+				event.Retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
@@ -50,7 +50,7 @@ documentation = `
                         value="{{$route.Method}}"
                         onClick="doRequest('{{ $route.Method }}',
                             '{{ js (printf "%s-%s" $route.Method $route.Path) }}',
-                            '{{ printf "http://%s%s" $page.Host $route.Path}}'
+                            '{{ printf "%s%s" $page.BaseURL $route.Path}}'
                     )">
                     {{ template "path-param" $route.Path }}
                     <br>
@@ -68,7 +68,7 @@ documentation = `
                         value="{{$route.Method}}"
                         onClick="doRequest('{{ $route.Method }}',
                             '{{ js (printf "%s-%s" $route.Method $route.Path) }}',
-                            '{{ printf "http://%s%s" $page.Host $route.Path}}'
+                            '{{ printf "%s%s" $page.BaseURL $route.Path}}'
                     )">
                     {{ template "path-param" $route.Path }}
                     <br>
@@ -86,7 +86,7 @@ documentation = `
                         value="{{$route.Method}}"
                         onClick="doRequest('{{ $route.Method }}',
                             '{{ js (printf "%s-%s" $route.Method $route.Path) }}',
-                            '{{ printf "http://%s%s" $page.Host $route.Path}}'
+                            '{{ printf "%s%s" $page.BaseURL $route.Path}}'
                     )">
                     {{ template "path-param" $route.Path }}
                     <br>
@@ -104,7 +104,7 @@ documentation = `
                         value="{{$route.Method}}"
                         onClick="doRequest('{{ $route.Method }}',
                             '{{ js (printf "%s-%s" $route.Method $route.Path) }}',
-                            '{{ printf "http://%s%s" $page.Host $route.Path}}'
+                            '{{ printf "%s%s" $page.BaseURL $route.Path}}'
                     )">
                     {{ template "path-param" $route.Path }}
                     <br>
@@ -0,0 +1,337 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package rest
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// KeyFunc identifies the caller of a request for a Throttle. The principal is
+// nil if the request wasn't authenticated or if the Throttle isn't
+// Authenticated.
+type KeyFunc func(httpReq *http.Request, principal *Principal) string
+
+// ClientIP is a KeyFunc which identifies callers by the IP address of the
+// remote end of their connection.
+func ClientIP(httpReq *http.Request, principal *Principal) string {
+	host, _, err := net.SplitHostPort(httpReq.RemoteAddr)
+	if err != nil {
+		return httpReq.RemoteAddr
+	}
+	return host
+}
+
+// HeaderKey returns a KeyFunc which identifies callers by the value of the
+// given header. Requests without the header share the same key.
+func HeaderKey(name string) KeyFunc {
+	return func(httpReq *http.Request, principal *Principal) string {
+		return httpReq.Header.Get(name)
+	}
+}
+
+// PrincipalKey is a KeyFunc which identifies callers by the subject of their
+// principal. Unauthenticated callers are identified by their IP address.
+// Throttles using PrincipalKey should be Authenticated as their Key otherwise
+// never receives a principal.
+func PrincipalKey(httpReq *http.Request, principal *Principal) string {
+	if principal == nil {
+		return "ip:" + ClientIP(httpReq, principal)
+	}
+	return "principal:" + principal.Subject
+}
+
+// Throttle limits the load accepted by a Mux or a Route. Each caller, as
+// identified by Key, has a token bucket to which tokens are added at Rate per
+// second up to Burst and each request consumes one token. Requests of callers
+// without tokens are rejected with a 429 status code. Requests beyond
+// MaxInFlight concurrent requests are rejected with a 503 status code. Both
+// rejections carry a Retry-After header and go through the ErrorFunc of the
+// Mux. Requests are throttled before their body is read except for the rate
+// limit of Authenticated throttles which is applied once the request is
+// authenticated. The tokens of a request rejected by another throttle are
+// refunded.
+type Throttle struct {
+
+	// Rate is the number of requests per second accepted from each caller.
+	// If not set then the rate isn't limited.
+	Rate float64
+
+	// Burst is the maximum number of requests accepted at once from each
+	// caller. Defaults to 1.
+	Burst int
+
+	// Key identifies the caller of a request. Defaults to ClientIP.
+	Key KeyFunc
+
+	// Authenticated applies the rate limit once the request is authenticated
+	// such that Key receives the principal of the request.
+	Authenticated bool
+
+	// MaxInFlight is the maximum number of requests processed concurrently.
+	// If not set then the number of concurrent requests isn't limited.
+	MaxInFlight int
+
+	mutex    sync.Mutex
+	buckets  map[string]*tokenBucket
+	swept    time.Time
+	inFlight int
+
+	limited    uint64
+	overloaded uint64
+}
+
+// ThrottleStats is a snapshot of the utilisation of a Throttle.
+type ThrottleStats struct {
+
+	// InFlight is the number of requests currently processed.
+	InFlight int
+
+	// MaxInFlight is the maximum number of requests processed concurrently
+	// or 0 if unlimited.
+	MaxInFlight int
+
+	// Callers is the number of callers which consumed tokens that weren't
+	// replenished yet.
+	Callers int
+
+	// Limited is the number of requests rejected because their caller
+	// exceeded the rate.
+	Limited uint64
+
+	// Overloaded is the number of requests rejected because MaxInFlight was
+	// reached.
+	Overloaded uint64
+}
+
+func (throttle *Throttle) burst() float64 {
+	if throttle.Burst > 0 {
+		return float64(throttle.Burst)
+	}
+	return 1
+}
+
+func (throttle *Throttle) key(httpReq *http.Request, principal *Principal) string {
+	if throttle.Key != nil {
+		return throttle.Key(httpReq, principal)
+	}
+	return ClientIP(httpReq, principal)
+}
+
+// refill adds the tokens accumulated since the last update of the bucket.
+func (throttle *Throttle) refill(b *tokenBucket, now time.Time) {
+	b.tokens = math.Min(b.tokens+now.Sub(b.last).Seconds()*throttle.Rate, throttle.burst())
+	b.last = now
+}
+
+// sweep removes the buckets which are full at most once a minute since they
+// are equivalent to missing buckets.
+func (throttle *Throttle) sweep(now time.Time) {
+	if now.Sub(throttle.swept) < time.Minute {
+		return
+	}
+	throttle.swept = now
+
+	for key, b := range throttle.buckets {
+		if throttle.refill(b, now); b.tokens >= throttle.burst() {
+			delete(throttle.buckets, key)
+		}
+	}
+}
+
+// take consumes a token of the given caller. Returns false and the delay
+// after which a token is available if the caller has no tokens.
+func (throttle *Throttle) take(key string, now time.Time) (time.Duration, bool) {
+	if throttle.Rate <= 0 {
+		return 0, true
+	}
+
+	if throttle.buckets == nil {
+		throttle.buckets = make(map[string]*tokenBucket)
+	}
+	throttle.sweep(now)
+
+	b, ok := throttle.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: throttle.burst(), last: now}
+		throttle.buckets[key] = b
+	}
+
+	if throttle.refill(b, now); b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / throttle.Rate * float64(time.Second)), false
+	}
+
+	b.tokens--
+	return 0, true
+}
+
+// refund returns the token consumed by a request of the given caller which
+// was rejected by another throttle.
+func (throttle *Throttle) refund(key string) {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	if b, ok := throttle.buckets[key]; ok {
+		b.tokens = math.Min(b.tokens+1, throttle.burst())
+	}
+}
+
+// enter reserves a slot for the request. If admitted then done must be called
+// once the request completes.
+func (throttle *Throttle) enter() (*Error, time.Duration) {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	if throttle.MaxInFlight > 0 && throttle.inFlight >= throttle.MaxInFlight {
+		throttle.overloaded++
+		return ErrorFmt(Overloaded, "too many requests in flight"), time.Second
+	}
+
+	throttle.inFlight++
+	return nil, 0
+}
+
+// limit consumes a token of the caller identified by the given key. Returns
+// the error and the delay to send in the Retry-After header if the caller has
+// no tokens.
+func (throttle *Throttle) limit(key string) (*Error, time.Duration) {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	if delay, ok := throttle.take(key, time.Now()); !ok {
+		throttle.limited++
+		return ErrorFmt(TooManyRequests, "rate limit exceeded: next request allowed in %s", delay), delay
+	}
+
+	return nil, 0
+}
+
+func (throttle *Throttle) done() {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	throttle.inFlight--
+}
+
+// Stats returns the current utilisation of the throttle.
+func (throttle *Throttle) Stats() ThrottleStats {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	now := time.Now()
+	callers := 0
+
+	for _, b := range throttle.buckets {
+		if throttle.refill(b, now); b.tokens < throttle.burst() {
+			callers++
+		}
+	}
+
+	return ThrottleStats{
+		InFlight:    throttle.inFlight,
+		MaxInFlight: throttle.MaxInFlight,
+		Callers:     callers,
+		Limited:     throttle.limited,
+		Overloaded:  throttle.overloaded,
+	}
+}
+
+// admission tracks the throttles which admitted a request.
+type admission struct {
+	entered []*Throttle
+	taken   []*Throttle
+	keys    []string
+}
+
+// refund returns the tokens consumed by the request.
+func (admission *admission) refund() {
+	for i, throttle := range admission.taken {
+		throttle.refund(admission.keys[i])
+	}
+	admission.taken, admission.keys = nil, nil
+}
+
+// release must be called once the admitted request completes.
+func (admission *admission) release() {
+	for _, throttle := range admission.entered {
+		throttle.done()
+	}
+}
+
+// throttle admits the request through the Throttle of the mux and then the
+// Throttle of the route before its body is read. The rate limits of
+// Authenticated throttles are left to throttleAuthenticated. Returns false if
+// the request was rejected in which case the error was already written to the
+// response. Otherwise release must be called once the request completes.
+func (mux *Mux) throttle(writer http.ResponseWriter, httpReq *http.Request, route *Route) (*admission, bool) {
+	admission := &admission{}
+
+	for _, throttle := range []*Throttle{mux.Throttle, route.Throttle} {
+		if throttle == nil {
+			continue
+		}
+
+		if restError, retryAfter := throttle.enter(); restError != nil {
+			admission.refund()
+			admission.release()
+			mux.rejectThrottled(writer, restError, retryAfter)
+			return nil, false
+		}
+		admission.entered = append(admission.entered, throttle)
+
+		if throttle.Authenticated {
+			continue
+		}
+
+		key := throttle.key(httpReq, nil)
+		if restError, retryAfter := throttle.limit(key); restError != nil {
+			admission.refund()
+			admission.release()
+			mux.rejectThrottled(writer, restError, retryAfter)
+			return nil, false
+		}
+		admission.taken = append(admission.taken, throttle)
+		admission.keys = append(admission.keys, key)
+	}
+
+	return admission, true
+}
+
+// throttleAuthenticated applies the rate limits of the Authenticated throttles
+// which admitted the request. Returns false if the request was rejected in
+// which case the error was already written to the response.
+func (mux *Mux) throttleAuthenticated(writer http.ResponseWriter, httpReq *http.Request, admission *admission, principal *Principal) bool {
+	for _, throttle := range admission.entered {
+		if !throttle.Authenticated {
+			continue
+		}
+
+		key := throttle.key(httpReq, principal)
+		if restError, retryAfter := throttle.limit(key); restError != nil {
+			admission.refund()
+			mux.rejectThrottled(writer, restError, retryAfter)
+			return false
+		}
+		admission.taken = append(admission.taken, throttle)
+		admission.keys = append(admission.keys, key)
+	}
+
+	return true
+}
+
+// rejectThrottled responds to a request rejected by a throttle.
+func (mux *Mux) rejectThrottled(writer http.ResponseWriter, restError *Error, retryAfter time.Duration) {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	writer.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+
+	code := http.StatusTooManyRequests
+	if restError.Type == Overloaded {
+		code = http.StatusServiceUnavailable
+	}
+
+	mux.respondError(writer, restError.Type, code, restError.Sub)
+}